@@ -0,0 +1,117 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+/*
+#include <stdlib.h>
+#include "luanative.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// Argument checks for GOLuaFunction implementations, they work like their lauxlib
+// counterparts. A failing check raises an error such as
+// "bad argument #2 to 'myAdd' (number expected, got string)" the same way State.Error
+// does, so the check does not return.
+
+// Raises a "bad argument" error for argument arg of the running Go function
+func (L *State) ArgError(arg int, extramsg string) {
+	cmsg := C.CString(extramsg)
+	C.pushArgError(L.s, C.int(arg), cmsg)
+	C.free(unsafe.Pointer(cmsg))
+	L.raiseTop(L.ToString(-1))
+}
+
+func (L *State) typeError(arg int, tname string) {
+	got := "no value"
+	if t := L.Type(arg); t != TNONE {
+		got = L.Typename(t)
+	}
+	L.ArgError(arg, tname+" expected, got "+got)
+}
+
+// Checks the argument is an integer, or a float/string with an exact integer value
+func (L *State) CheckInteger(arg int) int64 {
+	n, ok := L.ToIntegerX(arg)
+	if !ok {
+		if L.IsNumber(arg) {
+			L.ArgError(arg, "number has no integer representation")
+		}
+		L.typeError(arg, "number")
+	}
+	return n
+}
+
+// Checks the argument is a number or a string convertible to a number
+func (L *State) CheckNumber(arg int) float64 {
+	n, ok := L.ToNumberX(arg)
+	if !ok {
+		L.typeError(arg, "number")
+	}
+	return n
+}
+
+// Checks the argument is a string or a number
+func (L *State) CheckString(arg int) string {
+	if !L.IsString(arg) {
+		L.typeError(arg, "string")
+	}
+	return L.ToString(arg)
+}
+
+// Checks the argument is a table and returns a handle to it
+func (L *State) CheckTable(arg int) *Table {
+	if !L.IsTable(arg) {
+		L.typeError(arg, "table")
+	}
+	return L.ToTable(arg)
+}
+
+// Checks the argument is a Go value pushed to Lua and returns it
+func (L *State) CheckUserdata(arg int) interface{} {
+	v := L.ToInterface(arg)
+	if v == nil {
+		L.typeError(arg, "Go object")
+	}
+	return v
+}
+
+// Checks there is an argument at position arg, it can be nil
+func (L *State) CheckAny(arg int) {
+	if L.IsNone(arg) {
+		L.ArgError(arg, "value expected")
+	}
+}
+
+// Returns def if the argument is absent or nil, otherwise checks it like CheckInteger
+func (L *State) OptInteger(arg int, def int64) int64 {
+	if L.IsNoneOrNil(arg) {
+		return def
+	}
+	return L.CheckInteger(arg)
+}
+
+// Returns def if the argument is absent or nil, otherwise checks it like CheckString
+func (L *State) OptString(arg int, def string) string {
+	if L.IsNoneOrNil(arg) {
+		return def
+	}
+	return L.CheckString(arg)
+}
@@ -0,0 +1,60 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+type namedFunc struct {
+	name string
+	fn   func(L *State) int
+}
+
+func (f *namedFunc) Name() string {
+	return f.name
+}
+
+func (f *namedFunc) Invoke(L *State) int {
+	return f.fn(L)
+}
+
+func TestArgumentChecks(t *testing.T) {
+	L := newTestState(t)
+	L.ExportGoFunction(&namedFunc{"add", func(L *State) int {
+		L.PushInteger(L.CheckInteger(1) + L.OptInteger(2, 1))
+		return 1
+	}})
+	L.ExportGoFunction(&namedFunc{"name", func(L *State) int {
+		L.PushString(L.CheckUserdata(1).(*account).Name)
+		return 1
+	}})
+	pushGlobal(t, L, "acc", &account{Name: "a"})
+	run(t, L, `assert(add(3, 4) == 7 and add(3) == 4 and name(acc) == "a")`)
+	for code, want := range map[string]string{
+		`add(3, "x")`:     "bad argument #2 to 'add' (number expected, got string)",
+		`add(1.5)`:        "number has no integer representation",
+		`add()`:           "number expected, got no value",
+		`name(io.stdout)`: "Go object expected, got userdata",
+	} {
+		err := L.LoadCodeString(code, "check")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v", code, err)
+		}
+	}
+}
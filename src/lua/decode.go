@@ -0,0 +1,291 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var tableType = reflect.TypeOf((*Table)(nil))
+
+func conversionError(L *State, idx int, t reflect.Type) error {
+	return fmt.Errorf("cannot convert lua %s to %s", L.Typename(L.Type(idx)), t)
+}
+
+// State of one conversion from Lua, passed down the recursion over nested tables
+type decoder struct {
+	// Tables on the current path, to fail on cycles instead of recursing forever
+	visiting map[uintptr]bool
+	// Set by Unmarshal, struct fields are then matched the way Marshal names them
+	marshalNames bool
+	// Set by Get, scalars are converted as in strict mode whatever the State is set to
+	strict bool
+}
+
+// Every level of nested tables needs a few stack slots for lua_next and the key copy
+const decodeStackSlots = 4
+
+// Decodes the table at the absolute index idx into val
+func (d *decoder) tableToGo(L *State, val reflect.Value, idx int) error {
+	if val.Kind() == reflect.Ptr {
+		// The pointed to value is decoded from the same table
+		p := reflect.New(val.Type().Elem())
+		if err := d.luaToGo(L, p.Elem(), idx); err != nil {
+			return err
+		}
+		val.Set(p)
+		return nil
+	}
+	if !L.CheckStack(decodeStackSlots) {
+		return errors.New("lua: table nested too deeply")
+	}
+	ptr := L.toPointer(idx)
+	if d.visiting[ptr] {
+		return fmt.Errorf("lua: cannot convert a table containing itself to %s", val.Type())
+	}
+	if d.visiting == nil {
+		d.visiting = make(map[uintptr]bool)
+	}
+	d.visiting[ptr] = true
+	defer delete(d.visiting, ptr)
+	switch val.Kind() {
+	case reflect.Struct:
+		return d.tableToStruct(L, val, idx)
+	case reflect.Slice:
+		n := L.RawLen(idx)
+		s := reflect.MakeSlice(val.Type(), n, n)
+		if err := d.tableToArray(L, s, idx); err != nil {
+			return err
+		}
+		val.Set(s)
+	case reflect.Array:
+		return d.tableToArray(L, val, idx)
+	case reflect.Map:
+		return d.tableToMap(L, val, idx)
+	case reflect.Interface:
+		if val.NumMethod() != 0 {
+			return conversionError(L, idx, val.Type())
+		}
+		v, err := d.tableToInterface(L, idx)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(v))
+	default:
+		return conversionError(L, idx, val.Type())
+	}
+	return nil
+}
+
+// Fills the fields of val from the string keys of the table. Keys are matched the
+// same way the struct proxies match them, by json tag or by the upper cased name.
+func (d *decoder) tableToStruct(L *State, val reflect.Value, idx int) error {
+	t := val.Type()
+	build_struct_map(t)
+	L.PushNil()
+	for L.Next(idx) != 0 {
+		if L.Type(-2) == TSTRING {
+			key := L.ToString(-2)
+			var fname string
+			if d.marshalNames {
+				fname = get_marshal_field_name(t, key)
+			} else {
+				fname = get_field_name(t, key)
+			}
+			if fname != "" {
+				field := val.FieldByName(fname)
+				if field.IsValid() && field.CanSet() {
+					if err := d.luaToGo(L, field, -1); err != nil {
+						L.Pop(2)
+						return fmt.Errorf("field %s: %w", key, err)
+					}
+				}
+			}
+		}
+		L.Pop(1)
+	}
+	return nil
+}
+
+// Fills the slice or array val from t[1] to t[len(val)]
+func (d *decoder) tableToArray(L *State, val reflect.Value, idx int) error {
+	for i := 0; i < val.Len(); i++ {
+		L.RawGetI(idx, int64(i+1))
+		err := d.luaToGo(L, val.Index(i), -1)
+		L.Pop(1)
+		if err != nil {
+			return fmt.Errorf("index %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (d *decoder) tableToMap(L *State, val reflect.Value, idx int) error {
+	t := val.Type()
+	m := reflect.MakeMap(t)
+	L.PushNil()
+	for L.Next(idx) != 0 {
+		k := reflect.New(t.Key()).Elem()
+		v := reflect.New(t.Elem()).Elem()
+		// Decode a copy of the key, converting the key itself in place would break lua_next
+		L.PushValue(-2)
+		err := d.luaToGo(L, k, -1)
+		L.Pop(1)
+		if err == nil {
+			err = d.luaToGo(L, v, -1)
+		}
+		if err != nil {
+			key := keyString(L, -2)
+			L.Pop(2)
+			return fmt.Errorf("key %s: %w", key, err)
+		}
+		m.SetMapIndex(k, v)
+		L.Pop(1)
+	}
+	val.Set(m)
+	return nil
+}
+
+// Describes a table key for error messages, tables and functions by their type only so
+// no handle is made for them
+func keyString(L *State, idx int) string {
+	switch L.Type(idx) {
+	case TSTRING, TNUMBER, TBOOLEAN:
+		return fmt.Sprint(L.toGoValue(idx))
+	}
+	return L.Typename(L.Type(idx))
+}
+
+// Decodes a table into a []interface{} if it is a sequence, a map[string]interface{} otherwise
+func (d *decoder) tableToInterface(L *State, idx int) (interface{}, error) {
+	n := L.RawLen(idx)
+	count := 0
+	L.PushNil()
+	for L.Next(idx) != 0 {
+		count++
+		L.Pop(1)
+	}
+	if n > 0 && n == count {
+		s := make([]interface{}, n)
+		err := d.tableToArray(L, reflect.ValueOf(s), idx)
+		return s, err
+	}
+	m := make(map[string]interface{}, count)
+	L.PushNil()
+	for L.Next(idx) != 0 {
+		var key string
+		if L.Type(-2) == TSTRING {
+			key = L.ToString(-2)
+		} else {
+			key = fmt.Sprint(L.toGoValue(-2))
+		}
+		var v interface{}
+		if err := d.luaToGo(L, reflect.ValueOf(&v).Elem(), -1); err != nil {
+			L.Pop(2)
+			return nil, fmt.Errorf("key %s: %w", key, err)
+		}
+		m[key] = v
+		L.Pop(1)
+	}
+	return m, nil
+}
+
+// Converts scalar kinds in strict mode, the Lua value must have the matching type, fit
+// in the Go type and be integral for integer kinds. Reports false for other kinds.
+func strictScalar(L *State, val reflect.Value, idx int) (bool, error) {
+	kind := val.Kind()
+	switch kind {
+	case reflect.String:
+		if L.Type(idx) != TSTRING {
+			return true, conversionError(L, idx, val.Type())
+		}
+		val.SetString(L.ToString(idx))
+	case reflect.Bool:
+		if L.Type(idx) != TBOOLEAN {
+			return true, conversionError(L, idx, val.Type())
+		}
+		val.SetBool(L.ToBoolean(idx))
+	case reflect.Float32, reflect.Float64:
+		if L.Type(idx) != TNUMBER {
+			return true, conversionError(L, idx, val.Type())
+		}
+		f := L.ToNumber(idx)
+		if val.OverflowFloat(f) {
+			return true, fmt.Errorf("number %g overflows %s", f, val.Type())
+		}
+		val.SetFloat(f)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strictInteger(L, val, idx)
+		if err != nil {
+			return true, err
+		}
+		if val.OverflowInt(n) {
+			return true, fmt.Errorf("number %d overflows %s", n, val.Type())
+		}
+		val.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		if L.IsInteger(idx) {
+			n := L.ToInteger(idx)
+			if n < 0 {
+				return true, fmt.Errorf("negative number %d for %s", n, val.Type())
+			}
+			u = uint64(n)
+		} else {
+			if L.Type(idx) != TNUMBER {
+				return true, conversionError(L, idx, val.Type())
+			}
+			// Floats can hold values up to 2^64
+			f := L.ToNumber(idx)
+			if f != math.Trunc(f) {
+				return true, fmt.Errorf("number %g has no integer representation", f)
+			}
+			if f < 0 || f >= (1<<64) {
+				return true, fmt.Errorf("number %g overflows %s", f, val.Type())
+			}
+			u = uint64(f)
+		}
+		if val.OverflowUint(u) {
+			return true, fmt.Errorf("number %d overflows %s", u, val.Type())
+		}
+		val.SetUint(u)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Reads an integer number, floats are accepted only if they have an exact int64 value
+func strictInteger(L *State, val reflect.Value, idx int) (int64, error) {
+	if L.IsInteger(idx) {
+		return L.ToInteger(idx), nil
+	}
+	if L.Type(idx) != TNUMBER {
+		return 0, conversionError(L, idx, val.Type())
+	}
+	f := L.ToNumber(idx)
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("number %g has no integer representation", f)
+	}
+	if f < -(1<<63) || f >= (1<<63) {
+		return 0, fmt.Errorf("number %g overflows %s", f, val.Type())
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,150 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X    int `json:"x"`
+	Y    int
+	Tags []string
+}
+
+func TestDecodeTables(t *testing.T) {
+	L := newTestState(t)
+	var gotPoint point
+	var gotMap map[string]int
+	var gotAny interface{}
+	L.ExportFunc("take", func(p point, m map[string]int, a interface{}) {
+		gotPoint, gotMap, gotAny = p, m, a
+	})
+	run(t, L, `take({x = 1, y = 2, tags = {"a", "b"}}, {one = 1}, {1, {k = "v"}})`)
+	if want := (point{1, 2, []string{"a", "b"}}); !reflect.DeepEqual(gotPoint, want) {
+		t.Errorf("point = %+v", gotPoint)
+	}
+	if gotMap["one"] != 1 {
+		t.Errorf("map = %v", gotMap)
+	}
+	want := []interface{}{int64(1), map[string]interface{}{"k": "v"}}
+	if !reflect.DeepEqual(gotAny, want) {
+		t.Errorf("interface = %#v", gotAny)
+	}
+}
+
+func TestDecodeCyclicTable(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("any", func(v interface{}) {})
+	L.ExportFunc("list", func(v []interface{}) {})
+	L.ExportFunc("dict", func(v map[string]interface{}) {})
+	for _, fn := range []string{"any", "list", "dict"} {
+		code := `local t = {}; t[1] = t; t.self = t; ` + fn + `(t)`
+		err := L.LoadCodeString(code, "cycle")
+		if err == nil || !strings.Contains(err.Error(), "containing itself") {
+			t.Errorf("%s: error = %v", fn, err)
+		}
+	}
+	// The same table twice is not a cycle
+	run(t, L, `local s = {1}; any({s, s})`)
+}
+
+func TestDecodeDeeplyNestedTable(t *testing.T) {
+	L := newTestState(t)
+	depth := 0
+	L.ExportFunc("nested", func(v interface{}) {
+		for {
+			s, ok := v.([]interface{})
+			if !ok {
+				break
+			}
+			v = s[0]
+			depth++
+		}
+	})
+	run(t, L, `
+		local t = {false}
+		for i = 1, 500 do t = {t} end
+		nested(t)`)
+	// The innermost value is false, not a table
+	if depth != 501 {
+		t.Errorf("decoded %d levels", depth)
+	}
+}
+
+func TestDecodeAnonymousStructs(t *testing.T) {
+	L := newTestState(t)
+	var a struct{ A int }
+	var b struct{ B int }
+	L.ExportFunc("take", func(x struct{ A int }, y struct{ B int }) {
+		a, b = x, y
+	})
+	run(t, L, `take({a = 1}, {b = 2})`)
+	if a.A != 1 || b.B != 2 {
+		t.Errorf("a = %+v, b = %+v", a, b)
+	}
+}
+
+// Pushed as {r, g, b} and read back from it
+type rgb struct {
+	R, G, B int64
+}
+
+func (c *rgb) ToLUATable(L *State) error {
+	L.NewTable()
+	for i, v := range []int64{c.R, c.G, c.B} {
+		L.PushInteger(v)
+		L.RawSetI(-2, int64(i+1))
+	}
+	return nil
+}
+
+func (c *rgb) FromLUATable(L *State) error {
+	for i, p := range []*int64{&c.R, &c.G, &c.B} {
+		L.RawGetI(-1, int64(i+1))
+		n, ok := L.ToIntegerX(-1)
+		L.Pop(1)
+		if !ok {
+			return errors.New("color component is not an integer")
+		}
+		*p = n
+	}
+	return nil
+}
+
+func TestTableReaderWriter(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("brighten", func(c rgb) *rgb {
+		return &rgb{c.R + 1, c.G + 1, c.B + 1}
+	})
+	run(t, L, `
+		local c = brighten({1, 2, 3})
+		assert(type(c) == "table" and c[1] == 2 and c[2] == 3 and c[3] == 4)`)
+	if err := L.LoadCodeString(`brighten({1, "x", 3})`, "reader"); err == nil {
+		t.Error("a failing FromLUATable did not raise an error")
+	}
+	if err := Push(L, &rgb{5, 6, 7}); err != nil {
+		t.Fatal(err)
+	}
+	var c rgb
+	if err := L.ReadFormTable(&c, -1); err != nil || c != (rgb{5, 6, 7}) {
+		t.Errorf("ReadFormTable = %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,112 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+/*
+#include "luanative.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+// Status codes returned by lua_pcall / luaL_load*. ErrorStatus implements error so
+// errors.Is(err, lua.ERRSYNTAX) can be used on any error returned by this package.
+type ErrorStatus int
+
+const (
+	ERRRUN    = ErrorStatus(C.LUA_ERRRUN)
+	ERRSYNTAX = ErrorStatus(C.LUA_ERRSYNTAX)
+	ERRMEM    = ErrorStatus(C.LUA_ERRMEM)
+	ERRGCMM   = ErrorStatus(C.LUA_ERRGCMM)
+	ERRERR    = ErrorStatus(C.LUA_ERRERR)
+)
+
+func (s ErrorStatus) Error() string {
+	switch s {
+	case ERRRUN:
+		return "lua runtime error"
+	case ERRSYNTAX:
+		return "lua syntax error"
+	case ERRMEM:
+		return "lua memory allocation error"
+	case ERRGCMM:
+		return "lua error while running a __gc metamethod"
+	case ERRERR:
+		return "lua error while running the message handler"
+	}
+	return "lua error status " + strconv.Itoa(int(s))
+}
+
+// LuaError is returned by PCall and LoadCodeString when the script fails
+type LuaError struct {
+	// lua_pcall status of the failure
+	Status ErrorStatus
+	// Name of the chunk the error was raised in and the line within it, Line is 0 if unknown
+	Chunk string
+	Line  int
+	// Message is the error value as a string, Value is the original Lua error value
+	Message string
+	Value   interface{}
+	// Traceback of the Lua stack at the point of the error, empty for syntax and memory errors
+	Traceback string
+	// Go error raised by a callback, returned by Unwrap
+	cause error
+}
+
+func (e *LuaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status.Error(), e.Message)
+}
+
+// Makes errors.Is(err, lua.ERRRUN) etc. match on the status of the error
+func (e *LuaError) Is(target error) bool {
+	s, ok := target.(ErrorStatus)
+	return ok && s == e.Status
+}
+
+// Returns the Go error when the script failed because a Go callback raised one
+func (e *LuaError) Unwrap() error {
+	return e.cause
+}
+
+// Pushes the original error value so the error can be raised again
+func (e *LuaError) pushValue(L *State) {
+	if err, ok := e.Value.(error); ok {
+		L.pushGoError(err)
+	} else if goToLua(L, reflect.ValueOf(e.Value)) != nil {
+		L.Pop(1)
+		L.PushString(e.Message)
+	}
+}
+
+// Matches the "chunk:line:" prefix Lua adds to error messages
+var errorPosition = regexp.MustCompile(`^(\[string ".*?"\]|[^:\s]+):(\d+): `)
+
+// Fills the chunk name and line from the position prefix of the error message
+func (e *LuaError) positionFromMessage() {
+	m := errorPosition.FindStringSubmatch(e.Message)
+	if m != nil {
+		if e.Chunk == "" {
+			e.Chunk = m[1]
+		}
+		e.Line, _ = strconv.Atoi(m[2])
+	}
+}
@@ -0,0 +1,87 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLuaErrorFields(t *testing.T) {
+	L := newTestState(t)
+	err := L.LoadCodeString("local x = 1\nerror('failed here')", "chunk")
+	var lerr *LuaError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("error = %v, want a LuaError", err)
+	}
+	if lerr.Status != ERRRUN || !errors.Is(err, ERRRUN) {
+		t.Errorf("status = %v", lerr.Status)
+	}
+	if lerr.Chunk != "chunk" || lerr.Line != 2 {
+		t.Errorf("position = %s:%d", lerr.Chunk, lerr.Line)
+	}
+	if !strings.Contains(lerr.Message, "failed here") || lerr.Traceback == "" {
+		t.Errorf("message = %q, traceback = %q", lerr.Message, lerr.Traceback)
+	}
+
+	err = L.LoadCodeString("x = = 1", "bad")
+	if !errors.Is(err, ERRSYNTAX) || !errors.As(err, &lerr) || lerr.Line != 1 {
+		t.Errorf("syntax error = %v", err)
+	}
+}
+
+func TestErrorValueWithFailingToString(t *testing.T) {
+	L := newTestState(t)
+	for _, code := range []string{
+		`error(setmetatable({}, {__tostring = function() error("x") end}))`,
+		`error(setmetatable({}, {__tostring = function() return {} end}))`,
+	} {
+		err := L.LoadCodeString(code, "tostring")
+		var lerr *LuaError
+		if !errors.As(err, &lerr) || !strings.Contains(lerr.Message, "table value") {
+			t.Errorf("%s: error = %v", code, err)
+		}
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
+
+func TestPanickingCallback(t *testing.T) {
+	L := newTestState(t)
+	var handled interface{}
+	L.SetPanicHandler(func(L *State, r interface{}, stack []byte) {
+		handled = r
+	})
+	L.ExportFunc("explode", func() { panic("kaboom") })
+	run(t, L, `ok = pcall(explode)`)
+	if ok, _ := GetGlobalAs[bool](L, "ok"); ok {
+		t.Error("pcall of a panicking callback succeeded")
+	}
+	if handled != "kaboom" {
+		t.Errorf("panic handler got %v", handled)
+	}
+
+	err := L.LoadCodeString("explode()", "uncaught")
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "kaboom" {
+		t.Fatalf("error = %v, want a PanicError", err)
+	}
+	// The state stays usable after the panic
+	run(t, L, `x = 1 + 1`)
+}
@@ -0,0 +1,238 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+)
+
+// Keeps a Lua value alive in the registry for as long as Go holds on to it
+type luaRef struct {
+	L   *State
+	ref int
+}
+
+func (L *State) newLuaRef(idx int) *luaRef {
+	L.PushValue(idx)
+	r := &luaRef{L, L.Ref()}
+	// Finalizers run on their own goroutine, the Lua state can not be touched from there
+	runtime.SetFinalizer(r, func(r *luaRef) {
+		r.L.releaseLater(r.ref)
+	})
+	return r
+}
+
+// Implemented by the Go handles of Lua values, goToLua pushes the value itself
+type luaValue interface {
+	push()
+}
+
+var luaValueType = reflect.TypeOf((*luaValue)(nil)).Elem()
+
+func (r *luaRef) push() {
+	if r.ref == refReleased {
+		r.L.PushNil()
+	} else {
+		r.L.PushRef(r.ref)
+	}
+}
+
+func (r *luaRef) release() {
+	if r.ref != refReleased {
+		runtime.SetFinalizer(r, nil)
+		r.L.Unref(r.ref)
+		r.ref = refReleased
+	}
+}
+
+// LUA_NOREF, used for references that have been released
+const refReleased = -2
+
+// A Lua function held by Go, it stays valid after the call that handed it to Go has
+// returned so it can be stored and called later. Call Release once the function is no
+// longer needed, otherwise it is released when the Function is garbage collected.
+type Function struct {
+	*luaRef
+}
+
+// Returns a handle to the function at the given index, nil if the value is not a function
+func (L *State) ToFunction(idx int) *Function {
+	if L.Type(idx) != TFUNCTION {
+		return nil
+	}
+	return &Function{L.newLuaRef(idx)}
+}
+
+// Calls the function with the arguments converted to Lua values, and returns all its
+// results converted back to Go. Like PCall, a failing call returns a LuaError.
+func (f *Function) Call(args ...interface{}) ([]interface{}, error) {
+	L := f.L
+	if f.ref == refReleased {
+		return nil, errors.New("lua: call of a released function")
+	}
+	top := L.GetTop()
+	f.push()
+	return L.callPushed(top, args)
+}
+
+// Calls the function pushed just above top and returns all its results
+func (L *State) callPushed(top int, args []interface{}) ([]interface{}, error) {
+	if err := L.pushArgs(top, args); err != nil {
+		return nil, err
+	}
+	if err := L.PCall(len(args), MULTRET); err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, L.GetTop()-top)
+	for i := range ret {
+		ret[i] = L.toGoValue(top + 1 + i)
+	}
+	L.SetTop(top)
+	return ret, nil
+}
+
+// Pushes the arguments of a call, if one fails to convert the stack is reset to top
+func (L *State) pushArgs(top int, args []interface{}) error {
+	for _, arg := range args {
+		if err := goToLua(L, reflect.ValueOf(arg)); err != nil {
+			L.SetTop(top)
+			return err
+		}
+	}
+	return nil
+}
+
+// Releases the reference to the Lua function, the Function can not be called afterwards
+func (f *Function) Release() {
+	f.release()
+}
+
+// Wraps the Lua function at idx in a Go func of type t. Arguments and results are
+// converted the same way as for Go methods called from Lua. If t returns an error as
+// its last result a failing call is reported there, otherwise the call panics with a
+// *LuaError. Called from a Go callback, that panic raises the original error value in
+// Lua. The func must be called from the goroutine that uses the State.
+func (L *State) makeGoFunc(idx int, t reflect.Type) reflect.Value {
+	r := L.newLuaRef(idx)
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		return r.call(t, args)
+	})
+}
+
+func (r *luaRef) call(t reflect.Type, args []reflect.Value) []reflect.Value {
+	L := r.L
+	top := L.GetTop()
+	r.push()
+	nargs := len(args)
+	if t.IsVariadic() {
+		nargs--
+	}
+	var err error
+	for i := 0; i < nargs && err == nil; i++ {
+		err = goToLua(L, args[i])
+	}
+	if t.IsVariadic() {
+		rest := args[nargs]
+		for i := 0; i < rest.Len() && err == nil; i++ {
+			err = goToLua(L, rest.Index(i))
+		}
+		nargs += rest.Len()
+	}
+
+	out := make([]reflect.Value, t.NumOut())
+	nout := len(out)
+	hasErr := nout > 0 && t.Out(nout-1) == errorType
+	if hasErr {
+		nout--
+		out[nout] = reflect.Zero(errorType)
+	}
+	if err == nil {
+		err = L.PCall(nargs, MULTRET)
+	}
+	nres := L.GetTop() - top
+	for i := 0; i < nout; i++ {
+		out[i] = reflect.New(t.Out(i)).Elem()
+		if err == nil && i < nres {
+			err = luaToGo(L, out[i], top+1+i)
+		}
+	}
+	if err != nil && !hasErr {
+		L.SetTop(top)
+		// A callback up the stack catches the panic and raises the error in Lua again
+		panic(asLuaError(err))
+	}
+	if err != nil {
+		out[nout] = reflect.New(errorType).Elem()
+		out[nout].Set(reflect.ValueOf(err))
+	}
+	L.SetTop(top)
+	runtime.KeepAlive(r)
+	return out
+}
+
+// Returns err as a *LuaError, errors from the Go side of a call are runtime errors with
+// the Go error as value
+func asLuaError(err error) *LuaError {
+	if e, ok := err.(*LuaError); ok {
+		return e
+	}
+	return &LuaError{Status: ERRRUN, Message: err.Error(), Value: err, cause: err}
+}
+
+// Pushes the global function name, which can be a dotted path like "handlers.onRequest"
+func (L *State) pushGlobalFunction(name string) error {
+	if err := L.GetPath(name); err != nil {
+		L.Pop(1)
+		return err
+	}
+	if L.IsNil(-1) {
+		L.Pop(1)
+		return &LuaError{Status: ERRRUN, Message: "attempt to call a nil value (global '" + name + "')"}
+	}
+	return nil
+}
+
+// Calls the global function name with the arguments converted to Lua values and returns
+// all its results. The name can be a dotted path like "handlers.onRequest".
+func (L *State) CallGlobal(name string, args ...interface{}) ([]interface{}, error) {
+	top := L.GetTop()
+	if err := L.pushGlobalFunction(name); err != nil {
+		return nil, err
+	}
+	return L.callPushed(top, args)
+}
+
+// Calls the global function name like CallGlobal and converts its first result into a T,
+// see Get for the conversion rules
+func CallAs[T any](L *State, name string, args ...interface{}) (T, error) {
+	var ret T
+	top := L.GetTop()
+	if err := L.pushGlobalFunction(name); err != nil {
+		return ret, err
+	}
+	if err := L.pushArgs(top, args); err != nil {
+		return ret, err
+	}
+	if err := L.PCall(len(args), 1); err != nil {
+		return ret, err
+	}
+	ret, err := Get[T](L, -1)
+	L.SetTop(top)
+	return ret, err
+}
@@ -0,0 +1,122 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExportFunc(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("divmod", func(a, b int) (int, int) { return a / b, a % b })
+	L.ExportFunc("sum", func(ns ...float64) float64 {
+		total := 0.0
+		for _, n := range ns {
+			total += n
+		}
+		return total
+	})
+	L.ExportFunc("rename", func(a *account, name string) { a.Name = name })
+	L.PushGoFunc(strings.ToUpper)
+	L.SetGlobal("upper")
+	acc := &account{}
+	pushGlobal(t, L, "acc", acc)
+	run(t, L, `
+		local q, r = divmod(7, 2)
+		assert(q == 3 and r == 1)
+		assert(sum() == 0 and sum(1, 2.5) == 3.5)
+		rename(acc, upper("x"))`)
+	if acc.Name != "X" {
+		t.Errorf("name = %q", acc.Name)
+	}
+}
+
+func TestLuaFunctionAsGoFunc(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("apply", func(f func(int) int, n int) int { return f(n) })
+	L.ExportFunc("try", func(f func() (string, error)) string {
+		s, err := f()
+		if err != nil {
+			return "failed"
+		}
+		return s
+	})
+	run(t, L, `
+		assert(apply(function(n) return n * 2 end, 2) == 4)
+		assert(try(function() return "ok" end) == "ok")
+		assert(try(function() error("no") end) == "failed")`)
+}
+
+func TestLuaFunctionErrorKeepsValue(t *testing.T) {
+	L := newTestState(t)
+	var handled interface{}
+	L.SetPanicHandler(func(L *State, r interface{}, stack []byte) {
+		handled = r
+	})
+	L.ExportFunc("apply", func(f func(int) int, n int) int { return f(n) })
+	L.ExportFunc("boom", func() error { return errBoom })
+	run(t, L, `
+		local e = {}
+		local ok, got = pcall(apply, function(n) error(e) end, 1)
+		assert(not ok and rawequal(got, e), tostring(got))
+		pcall_boom = function() apply(function(n) boom() end, 1) end`)
+	if handled != nil {
+		t.Errorf("panic handler called with %v", handled)
+	}
+	err := L.LoadCodeString(`pcall_boom()`, "boom")
+	if !errors.Is(err, errBoom) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestFunctionCallAfterRelease(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `function twice(n) return n * 2 end`)
+	L.GetGlobal("twice")
+	fn := L.ToFunction(-1)
+	L.Pop(1)
+	res, err := fn.Call(21)
+	if err != nil || len(res) != 1 || res[0] != int64(42) {
+		t.Fatalf("Call = %v, %v", res, err)
+	}
+	fn.Release()
+	if _, err := fn.Call(1); err == nil {
+		t.Error("call of a released function succeeded")
+	}
+}
+
+func TestCallGlobal(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `
+		function greet(name) return "hi " .. name, #name end
+		handlers = {double = function(n) return n * 2 end}`)
+	res, err := L.CallGlobal("greet", "bob")
+	if err != nil || len(res) != 2 || res[0] != "hi bob" || res[1] != int64(3) {
+		t.Errorf("greet = %v, %v", res, err)
+	}
+	if n, err := CallAs[int](L, "handlers.double", 21); err != nil || n != 42 {
+		t.Errorf("handlers.double = %d, %v", n, err)
+	}
+	if _, err := L.CallGlobal("missing"); !errors.Is(err, ERRRUN) {
+		t.Errorf("missing = %v", err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
@@ -0,0 +1,95 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"reflect"
+)
+
+// Converts the value at idx into a T. Unlike the lenient conversion of method arguments
+// the Lua type has to match whatever the State is set to: scalars are converted as in
+// strict mode, other types need a Go object of the type or a table they can be decoded
+// from. nil is an error unless T is an interface type.
+func Get[T any](L *State, idx int) (T, error) {
+	var ret T
+	val := reflect.ValueOf(&ret).Elem()
+	if err := checkValueType(L, val.Type(), idx); err != nil {
+		return ret, err
+	}
+	d := &decoder{strict: true}
+	if err := d.luaToGo(L, val, idx); err != nil {
+		var zero T
+		return zero, err
+	}
+	return ret, nil
+}
+
+// Pushes v the same way PushInterface does
+func Push[T any](L *State, v T) error {
+	return goToLua(L, reflect.ValueOf(&v).Elem())
+}
+
+// Converts the global name into a T, see Get
+func GetGlobalAs[T any](L *State, name string) (T, error) {
+	top := L.GetTop()
+	L.GetGlobal(name)
+	ret, err := Get[T](L, -1)
+	L.SetTop(top)
+	return ret, err
+}
+
+// Checks the Lua value at idx can be converted into a non scalar t, scalars are left
+// to strictScalar
+func checkValueType(L *State, t reflect.Type, idx int) error {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface:
+		return nil
+	}
+	ok := false
+	switch L.Type(idx) {
+	case TUSERDATA:
+		ok = L.ToInterface(idx) != nil
+	case TTABLE:
+		ok = decodesTable(t)
+	case TFUNCTION:
+		ok = t.Kind() == reflect.Func
+	case TSTRING:
+		ok = t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+	}
+	if !ok {
+		return conversionError(L, idx, t)
+	}
+	return nil
+}
+
+// Reports whether luaToGo decodes tables into values of type t
+func decodesTable(t reflect.Type) bool {
+	if t == tableType || t.Implements(tableReaderType) || reflect.PtrTo(t).Implements(tableReaderType) {
+		return true
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
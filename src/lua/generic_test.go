@@ -0,0 +1,57 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import "testing"
+
+func TestGetChecksType(t *testing.T) {
+	L := newTestState(t)
+	acc := &account{Name: "a"}
+	pushGlobal(t, L, "acc", acc)
+	run(t, L, `
+		num, frac, str, tbl = "12", 1.5, "x", {x = 1, y = 2}
+		fn = function() end`)
+	fails := []struct {
+		name string
+		get  func() error
+	}{
+		{"num", func() error { _, err := GetGlobalAs[int](L, "num"); return err }},
+		{"frac", func() error { _, err := GetGlobalAs[int](L, "frac"); return err }},
+		{"missing", func() error { _, err := GetGlobalAs[*account](L, "missing"); return err }},
+		{"str", func() error { _, err := GetGlobalAs[*account](L, "str"); return err }},
+		{"tbl", func() error { _, err := GetGlobalAs[*int](L, "tbl"); return err }},
+		{"fn", func() error { _, err := GetGlobalAs[point](L, "fn"); return err }},
+		{"acc", func() error { _, err := GetGlobalAs[point](L, "acc"); return err }},
+	}
+	for _, c := range fails {
+		if c.get() == nil {
+			t.Errorf("converting %s succeeded", c.name)
+		}
+	}
+	if got, err := GetGlobalAs[*account](L, "acc"); err != nil || got != acc {
+		t.Errorf("acc = %v, %v", got, err)
+	}
+	if got, err := GetGlobalAs[*point](L, "tbl"); err != nil || got.X != 1 || got.Y != 2 {
+		t.Errorf("tbl = %+v, %v", got, err)
+	}
+	if got, err := GetGlobalAs[interface{}](L, "missing"); err != nil || got != nil {
+		t.Errorf("missing = %v, %v", got, err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
@@ -0,0 +1,50 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import "testing"
+
+func TestMapPairsSorted(t *testing.T) {
+	L := newTestState(t)
+	L.SetSortMapKeys(true)
+	pushGlobal(t, L, "m", map[string]int{"c": 3, "a": 1, "b": 2})
+	run(t, L, `
+		result = ""
+		for k, v in pairs(m) do result = result .. k .. v end`)
+	if got := globalString(t, L, "result"); got != "a1b2c3" {
+		t.Errorf("result = %q", got)
+	}
+}
+
+func TestPairsRoundTrip(t *testing.T) {
+	L := newTestState(t)
+	pushGlobal(t, L, "acc", &account{Name: "a", Balance: 3, Base: Base{ID: 7}})
+	run(t, L, `
+		for i = 1, 2 do
+			local n = 0
+			for k, v in pairs(acc) do
+				assert(acc[k] == v, k)
+				n = n + 1
+			end
+			assert(n == #acc, "pairs visited " .. n .. " of " .. #acc)
+			collectgarbage()
+		end
+		result = acc.name .. acc.ID`)
+	if got := globalString(t, L, "result"); got != "a7" {
+		t.Errorf("result = %q", got)
+	}
+}
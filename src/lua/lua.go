@@ -28,11 +28,14 @@ import "C"
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"unsafe"
 	"unicode"
 	"strings"
 	"sync"
+	"runtime"
+	debug_stack "runtime/debug"
 	//	"strconv"
 )
 
@@ -41,8 +44,16 @@ func debug(str interface{}) {
 //		print ("\n")
 }
 
-var global_field_map = make(map[string]map[string]string)
-var global_method_map = make (map[string]map[string]string)
+// Keyed by the struct type, anonymous structs and types of the same name from different
+// packages each get their own maps
+var global_field_map = make(map[reflect.Type]map[string]string)
+var global_method_map = make (map[reflect.Type]map[string]string)
+// Lua visible names of the fields and methods of a struct type in the order pairs visits them
+var global_field_list = make(map[reflect.Type][]string)
+var global_method_list = make(map[reflect.Type][]string)
+// Guards the maps above and marshal_field_map, they are shared by all States. The inner
+// maps and lists are not changed once stored so they can be used after unlocking.
+var struct_map_lock sync.Mutex
 
 type Lib int
 
@@ -57,14 +68,99 @@ const (
 	BASE    Lib = 0
 )
 
+// Lua value types as returned by Type
+const (
+	TNONE          = int(C.LUA_TNONE)
+	TNIL           = int(C.LUA_TNIL)
+	TBOOLEAN       = int(C.LUA_TBOOLEAN)
+	TLIGHTUSERDATA = int(C.LUA_TLIGHTUSERDATA)
+	TNUMBER        = int(C.LUA_TNUMBER)
+	TSTRING        = int(C.LUA_TSTRING)
+	TTABLE         = int(C.LUA_TTABLE)
+	TFUNCTION      = int(C.LUA_TFUNCTION)
+	TUSERDATA      = int(C.LUA_TUSERDATA)
+	TTHREAD        = int(C.LUA_TTHREAD)
+)
+
+// Pass as nresults to PCall to keep all the results of the call
+const MULTRET = -1
+
+// Implement this interface to decode a value from a Lua table yourself. FromLUATable is
+// called with the table on top of the stack whenever the value is read from a table,
+// as a method argument, a struct field or through ReadFormTable.
 type LuaTableReader interface {
 	FromLUATable ( *State) error
 }
 
+// Implement this interface to build the Lua representation of a value yourself.
+// ToLUATable must push exactly one value, it is called whenever the value is pushed
+// to Lua, as a method result, a struct field or through PushInterface and Marshal.
 type LuaTableWriter interface {
 	ToLUATable ( *State) error
 }
 
+var tableReaderType = reflect.TypeOf((*LuaTableReader)(nil)).Elem()
+
+// Returns the LuaTableWriter implemented by val or by its address, nil if there is none
+func tableWriter(val reflect.Value) LuaTableWriter {
+	if !val.IsValid() || !val.CanInterface() {
+		return nil
+	}
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if val.IsNil() {
+			return nil
+		}
+	}
+	if w, ok := val.Interface().(LuaTableWriter); ok {
+		return w
+	}
+	if val.CanAddr() {
+		if w, ok := val.Addr().Interface().(LuaTableWriter); ok {
+			return w
+		}
+	}
+	return nil
+}
+
+// Calls ToLUATable making sure it pushed exactly one value, nothing is left pushed on error
+func (L *State) callTableWriter(w LuaTableWriter) error {
+	top := L.GetTop()
+	err := w.ToLUATable(L)
+	if err == nil && L.GetTop() != top+1 {
+		err = fmt.Errorf("lua: %T.ToLUATable pushed %d values instead of one", w, L.GetTop()-top)
+	}
+	if err != nil {
+		L.SetTop(top)
+	}
+	return err
+}
+
+// Returns the LuaTableReader implemented by val or by its address, nil if there is none.
+// A nil pointer implementing the interface is set to a new value first.
+func tableReader(val reflect.Value) LuaTableReader {
+	t := val.Type()
+	if t.Kind() == reflect.Ptr && t.Implements(tableReaderType) {
+		if val.IsNil() {
+			val.Set(reflect.New(t.Elem()))
+		}
+		return val.Interface().(LuaTableReader)
+	}
+	if val.CanAddr() && reflect.PtrTo(t).Implements(tableReaderType) {
+		return val.Addr().Interface().(LuaTableReader)
+	}
+	return nil
+}
+
+// Calls FromLUATable with a copy of the table at idx on top of the stack
+func (L *State) callTableReader(reader LuaTableReader, idx int) error {
+	top := L.GetTop()
+	L.PushValue(idx)
+	err := reader.FromLUATable(L)
+	L.SetTop(top)
+	return err
+}
+
 func is_valid_name(name string) bool {
 	r := rune(name[0])
 	return !unicode.IsLower(r)
@@ -72,14 +168,16 @@ func is_valid_name(name string) bool {
 
 func build_struct_map(t reflect.Type) {
 //	debug ("Building struct map for "+t.Name())
-	m := global_field_map[t.Name()]
+	struct_map_lock.Lock()
+	defer struct_map_lock.Unlock()
+	m := global_field_map[t]
 	if m == nil {
 		m := make(map[string]string)
 		build_map_recursive(t, m)
-		global_field_map[t.Name()] = m
+		global_field_map[t] = m
 //		fmt.Println(global_field_map)
 	}
-	method_map := global_method_map[t.Name()]
+	method_map := global_method_map[t]
 	if (method_map == nil) {
 		method_map := make (map[string]string)
 		for i := 0; i < t.NumMethod() ; i++ {
@@ -90,17 +188,75 @@ func build_struct_map(t reflect.Type) {
 			}
 			
 		}
-		global_method_map[t.Name()] = method_map
+		global_method_map[t] = method_map
+	}
+	if global_field_list[t] == nil {
+		m := global_field_map[t]
+		names := make([]string, 0, t.NumField())
+		build_list_recursive(t, m, make(map[string]bool), &names)
+		global_field_list[t] = names
+		// Methods of the pointer are reachable as get_method tries the pointer first
+		methods := make([]string, 0)
+		pt := reflect.PtrTo(t)
+		for i := 0; i < pt.NumMethod(); i++ {
+			m_name := pt.Method(i).Name
+			if lookup_field_name(m, m_name) == "" {
+				methods = append(methods, m_name)
+			}
+		}
+		global_method_list[t] = methods
+	}
+}
+
+// Collects the names the getter accepts for the fields, one per field: the json tag name
+// or else the Go name. Embedded structs are flattened the way build_map_recursive does
+// and names the getter resolves to another field are left out.
+func build_list_recursive(t reflect.Type, field_map map[string]string, seen map[string]bool, names *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !is_valid_name(field.Name) || field.PkgPath != "" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type.Name() == field.Name {
+			build_list_recursive(field.Type, field_map, seen, names)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+		if !seen[name] && lookup_field_name(field_map, name) == field.Name {
+			seen[name] = true
+			*names = append(*names, name)
+		}
+	}
+}
+
+// Names pairs and # expose for a struct, the methods only if enabled on the State
+func struct_lua_names(L *State, t reflect.Type) []string {
+	struct_map_lock.Lock()
+	names := global_field_list[t]
+	methods := global_method_list[t]
+	struct_map_lock.Unlock()
+	if L.pairsMethods {
+		names = append(names[:len(names):len(names)], methods...)
 	}
+	return names
 }
 
 
-func get_field_name(type_name string, fname string) string {
+func get_field_name(t reflect.Type, fname string) string {
+//	fmt.Println ("Looking for "+t.Name())
+//	fmt.Println(global_field_map)
+	struct_map_lock.Lock()
+	m := global_field_map[t]
+	struct_map_lock.Unlock()
+	return lookup_field_name(m, fname)
+}
+
+func lookup_field_name(m map[string]string, fname string) string {
 	var ret string
 	ret = ""
-//	fmt.Println ("Looking for "+type_name)
-//	fmt.Println(global_field_map)
-	m := global_field_map[type_name]
 	if (m != nil) {
 		ret = m[fname]
 //		fmt.Println ("Looking for Field"+fname)
@@ -129,6 +285,66 @@ func get_method_name(type_name string, mname string) string {
 
 
 
+// Returns the name given to a field by its lua tag, or by its json tag when it has no
+// lua tag, and whether the field is tagged omitempty or is skipped with "-"
+func field_tag(field reflect.StructField) (name string, omitempty bool, skip bool) {
+	tag, ok := field.Tag.Lookup("lua")
+	if !ok {
+		tag = field.Tag.Get("json")
+	}
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return parts[0], omitempty, false
+}
+
+// Field names used by Marshal and Unmarshal, keyed by the struct type. Unlike the
+// proxy field map it honors lua tags, "-" and only flattens untagged embedded structs.
+var marshal_field_map = make(map[reflect.Type]map[string]string)
+
+func get_marshal_field_name(t reflect.Type, fname string) string {
+	struct_map_lock.Lock()
+	m := marshal_field_map[t]
+	if m == nil {
+		m = make(map[string]string)
+		build_marshal_map(t, m)
+		marshal_field_map[t] = m
+	}
+	struct_map_lock.Unlock()
+	ret := m[fname]
+	if ret == "" {
+		ret = m[strings.ToUpper(fname)]
+	}
+	return ret
+}
+
+func build_marshal_map(t reflect.Type, field_map map[string]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag_name, _, skip := field_tag(field)
+		if skip {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && tag_name == "" {
+			build_marshal_map(field.Type, field_map)
+			continue
+		}
+		field_map[strings.ToUpper(field.Name)] = field.Name
+		if tag_name != "" {
+			field_map[tag_name] = field.Name
+		}
+	}
+}
+
 func build_map_recursive(t reflect.Type, field_map map[string]string ) {
 	for i := 0; i < t.NumField() ; i++ {
 		field := t.Field(i)
@@ -164,8 +380,28 @@ type State struct {
 	obj_table map[int64]*wrapper
 	curr_id int64
 	lock *sync.Mutex
+	panicHandler func(L *State, r interface{}, stack []byte)
+	released_refs []int
+	// Argument count policy of reflected Go functions and methods
+	zeroFillArgs bool
+	rejectExtraArgs bool
+	errorConvention ErrorConvention
+	strict bool
+	sortMapKeys bool
+	pairsMethods bool
 }
 
+// How a non nil error returned as the last result of a reflected Go function or method,
+// or passed to ReturnError, reaches the script
+type ErrorConvention int
+
+const (
+	// The error is raised as a Lua error, this is the default
+	RaiseErrors ErrorConvention = iota
+	// The function returns nil and the error message, like io.open does
+	ReturnErrors
+)
+
 type GOLuaFunction interface {
 	Invoke(L *State) int
 }
@@ -210,39 +446,164 @@ type luaErrorI interface {
 	error
 }
 
+// The method of a pushed object, created once per object and method and kept as long as
+// Lua references it so it can be stored in a local and called any number of times
 type methodInvoker struct {
 	method string
 	value  interface{}
+	fn     reflect.Value
+	// Wrapper id of the proxy the method was read from, so p:m() can be told from p.m()
+	self   int64
+}
+
+// With colon syntax the receiver proxy comes in as the first argument. It is dropped
+// when there are more arguments than the method takes, so p:Equals(q) calls Equals(q),
+// or when the method has no first parameter the receiver fits, so p:m() and p.m() call
+// the same method. p.Equals(p) keeps the proxy as the argument.
+func (m *methodInvoker) dropReceiver(L *State) {
+	if L.GetTop() == 0 || int64(C.toUserData(L.s, 1)) != m.self {
+		return
+	}
+	funcT := m.fn.Type()
+	fixed := funcT.NumIn()
+	if funcT.IsVariadic() {
+		fixed--
+	}
+	fits := funcT.NumIn() > 0 && reflect.TypeOf(m.value).AssignableTo(funcT.In(0))
+	if L.GetTop() > fixed || !fits {
+		L.Remove(1)
+	}
 }
 
 func (m *methodInvoker) Invoke(L *State) int {
-	method, _ := get_method(m.value, m.method)
-	in := make([]reflect.Value, method.Type().NumIn())
-	var ret int
-	//fmt.Printf("Get Top %s %d len %d\n",m.method , L.GetTop(), len(in))
-	if L.GetTop() >= len(in) {
-		funcT := method.Type()
-		for j := 0; j < len(in); j++ {
-			t := funcT.In(j)
-			d := reflect.New(t)
-			luaToGo(L, d.Elem(), (j + 1))
-			in[j] = d.Elem()
-		}
-		debug(method.String())
-		out := method.Call(in)
-		ret = len(out)
+	m.dropReceiver(L)
+	debug(m.fn.String())
+	return callReflected(L, m.fn, m.name())
+}
+
+// Name used in error messages, the Go type and the method e.g. *main.Person.SetName
+func (m *methodInvoker) name() string {
+	return fmt.Sprintf("%s.%s", reflect.TypeOf(m.value), m.method)
+}
+
+// Calls a Go func bound with PushGoFunc or ExportFunc
+type funcInvoker struct {
+	name string
+	fn   reflect.Value
+}
+
+func (f *funcInvoker) Invoke(L *State) int {
+	return callReflected(L, f.fn, f.name)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Missing trailing arguments of reflected Go functions and methods are passed as the
+// zero value of the parameter type instead of raising an error. Off by default.
+func (L *State) SetZeroFillArgs(on bool) {
+	L.zeroFillArgs = on
+}
+
+// Calling a reflected Go function or method with more arguments than it takes raises
+// an error instead of ignoring the extra ones. Off by default, variadic functions take
+// any number of arguments.
+func (L *State) SetRejectExtraArgs(on bool) {
+	L.rejectExtraArgs = on
+}
+
+// In strict mode values converted from Lua must have the type the Go side expects, a
+// string is not read as a number, nil is not read as "" or 0, numbers must fit in the
+// Go type and be integral for integer types. Setting an unknown field of a Go object
+// raises an error. Off by default, the lenient mode coerces the way the Lua API does.
+func (L *State) SetStrictConversion(on bool) {
+	L.strict = on
+}
+
+// pairs over a Go map visits the keys in sorted order instead of Go's random map order,
+// useful to get the same script output on every run. Off by default.
+func (L *State) SetSortMapKeys(on bool) {
+	L.sortMapKeys = on
+}
+
+// pairs and # over a Go struct include its methods after the fields. Off by default.
+func (L *State) SetPairsMethods(on bool) {
+	L.pairsMethods = on
+}
+
+// Sets how errors returned by Go functions and methods are handed to the script, see
+// ErrorConvention. On success the trailing error result is dropped in both modes.
+func (L *State) SetErrorConvention(c ErrorConvention) {
+	L.errorConvention = c
+}
+
+// Hands err to the script following the error convention of the State, for use in the
+// Invoke method of exported functions as in
+//	if err != nil {
+//		return L.ReturnError(err)
+//	}
+// With RaiseErrors it does not return, with ReturnErrors it pushes nil and the message.
+func (L *State) ReturnError(err error) int {
+	if L.errorConvention == ReturnErrors {
 		L.SetTop(0)
-		for i := 0; i < ret; i++ {
-			goToLua(L, out[i])
-		}
-	} else {
-		str := fmt.Sprintf("Not enough arguments for call %s, require %d parameters call only supplied %d ", m.method, len(in), L.GetTop())
+		L.PushNil()
+		L.PushString(err.Error())
+		return 2
+	}
+	L.RaiseError(err)
+	return 0
+}
+
+// Calls fn with the values on the stack converted to its parameter types and pushes
+// the results back. Variadic parameters take all the remaining values and a non nil
+// trailing error result is handed to the script with ReturnError.
+func callReflected(L *State, fn reflect.Value, name string) int {
+	funcT := fn.Type()
+	top := L.GetTop()
+	fixed := funcT.NumIn()
+	if funcT.IsVariadic() {
+		fixed--
+	}
+	if top < fixed && !L.zeroFillArgs {
+		str := fmt.Sprintf("Not enough arguments for call %s, require %d parameters call only supplied %d ", name, fixed, top)
 		L.Error(str)
-//		debug("method Invoked Failed not enough params")
-		return 0
 	}
-
-	return ret
+	if top > fixed && !funcT.IsVariadic() && L.rejectExtraArgs {
+		L.Error(fmt.Sprintf("too many arguments to '%s' (expected %d, got %d)", name, fixed, top))
+	}
+	in := make([]reflect.Value, 0, fixed)
+	for j := 0; j < fixed; j++ {
+		if j >= top {
+			in = append(in, reflect.Zero(funcT.In(j)))
+			continue
+		}
+		d := reflect.New(funcT.In(j)).Elem()
+		if err := luaToGo(L, d, j+1); err != nil {
+			L.Error(fmt.Sprintf("bad argument #%d to '%s' (%s)", j+1, name, err))
+		}
+		in = append(in, d)
+	}
+	if funcT.IsVariadic() {
+		elemT := funcT.In(fixed).Elem()
+		for j := fixed; j < top; j++ {
+			d := reflect.New(elemT).Elem()
+			if err := luaToGo(L, d, j+1); err != nil {
+				L.Error(fmt.Sprintf("bad argument #%d to '%s' (%s)", j+1, name, err))
+			}
+			in = append(in, d)
+		}
+	}
+	out := fn.Call(in)
+	L.SetTop(0)
+	if n := len(out); n > 0 && funcT.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			return L.ReturnError(err)
+		}
+		out = out[:n-1]
+	}
+	for i := 0; i < len(out); i++ {
+		L.pushResult(out[i])
+	}
+	return len(out)
 }
 
 func (err *luaError) Error() string {
@@ -324,6 +685,23 @@ func (L *State) IsBoolean(index int) bool {
 	return int(C.lua_type(L.s, C.int(index))) == C.LUA_TBOOLEAN
 }
 
+func (L *State) IsFunction(index int) bool {
+	return int(C.lua_type(L.s, C.int(index))) == C.LUA_TFUNCTION
+}
+
+func (L *State) IsCFunction(index int) bool {
+	return C.lua_iscfunction(L.s, C.int(index)) == 1
+}
+
+// True only for numbers with the integer subtype, floats with an integral value are not integers
+func (L *State) IsInteger(index int) bool {
+	return C.lua_isinteger(L.s, C.int(index)) == 1
+}
+
+func (L *State) IsThread(index int) bool {
+	return int(C.lua_type(L.s, C.int(index))) == C.LUA_TTHREAD
+}
+
 // Push methods
 func (L *State) PushBoolean(b bool) {
 	var bint int
@@ -335,14 +713,18 @@ func (L *State) PushBoolean(b bool) {
 	C.lua_pushboolean(L.s, C.int(bint))
 }
 
+// Strings are pushed with their length so they can hold any bytes, including \0
 func (L *State) PushString(str string) {
-	cstr := C.CString(str)
-	C.lua_pushstring(L.s, cstr)
-	C.free(unsafe.Pointer(cstr))
+	C.lua_pushlstring(L.s, (*C.char)(unsafe.Pointer(unsafe.StringData(str))), C.size_t(len(str)))
+}
+
+// Pushes the bytes as a Lua string
+func (L *State) PushBytes(b []byte) {
+	C.lua_pushlstring(L.s, (*C.char)(unsafe.Pointer(unsafe.SliceData(b))), C.size_t(len(b)))
 }
 
-func (L *State) PushInteger(n int) {
-	C.lua_pushinteger(L.s, C.lua_Integer(C.int(n)))
+func (L *State) PushInteger(n int64) {
+	C.lua_pushinteger(L.s, C.lua_Integer(n))
 }
 
 func (L *State) PushNil() {
@@ -357,55 +739,57 @@ func (L *State) PushValue(index int) {
 	C.lua_pushvalue(L.s, C.int(index))
 }
 
-func (L *State) PushInterface(val interface{}) {
+// Pushes any Go value. Booleans, numbers and strings become native Lua values, nil and
+// nil pointers become nil and funcs become callable Lua functions. Any other value is
+// pushed as a proxy userdata giving the script access to the Go value, see goToLua.
+// If a LuaTableWriter fails nil is pushed and the error returned.
+func (L *State) PushInterface(val interface{}) error {
+	return goToLua(L, reflect.ValueOf(val))
+}
+
+// Pushes a proxy userdata for the Go value, the metatable gives access to the fields and
+// methods of structs and the elements of slices and maps
+func (L *State) pushProxy(val interface{}) {
+	w := L.newWrapper()
+	w.v = val
+	w.pointer = 0
 	
-	str, str_ok := val.(string)
-	in, int_ok := val.(int64)
-	fl, float_ok := val.(float64)
-	if str_ok {
-		L.PushString (str)
-	}else if int_ok {
-		L.PushInteger (int(in))
-	}else if float_ok {
-		L.PushNumber (fl)
-	}else {
-		w := L.newWrapper()
-		w.v = val
-		w.pointer = 0
-		
-		if reflect.ValueOf(val).Kind() == reflect.Ptr {
-			w.pointer = 1
-		}
-		//	debug (val)
-		//	w.name = "Test"
-		w.isFunction = 0
-		var k reflect.Kind
-		var sType reflect.Type
-		
-		if w.pointer == 1 {
-			//		debug ("Pointer ....")
-			k = reflect.ValueOf(val).Elem().Kind()
-			sType = reflect.ValueOf(val).Elem().Type()
-		} else {
-			//		debug ("Not Pointer")
-			k = reflect.ValueOf(val).Kind()
-			sType = reflect.ValueOf(val).Type()
-		}
-		w.obj_type = k
-		debug(" Kind is " + k.String())
-		if (k != reflect.Slice) && (k != reflect.Struct) && (k != reflect.Map) {
-			panic("The pushed interface can only be a Slice, Map or Struct")
-		}
-		//	debug ("---------------")
-		//	debug (reflect.ValueOf(&w).Pointer())
-		//	C.pushObject(L.s, unsafe.Pointer(&w))
-		if (k == reflect.Struct ) {
-			w.name = sType.Name()
-			build_struct_map (sType)
-		}
-	//	L.obj_table = append(L.obj_table, val)
-		C.pushObject(L.s,  C.longlong(w.id), 1)
-	//	debug (w.pointer)
+	if reflect.ValueOf(val).Kind() == reflect.Ptr {
+		w.pointer = 1
+	}
+	w.isFunction = 0
+	var k reflect.Kind
+	var sType reflect.Type
+	
+	if w.pointer == 1 {
+		k = reflect.ValueOf(val).Elem().Kind()
+		sType = reflect.ValueOf(val).Elem().Type()
+	} else {
+		k = reflect.ValueOf(val).Kind()
+		sType = reflect.ValueOf(val).Type()
+	}
+	w.obj_type = k
+	debug(" Kind is " + k.String())
+	if (k == reflect.Struct ) {
+		w.name = sType.Name()
+		build_struct_map (sType)
+	}
+	C.pushObject(L.s,  C.longlong(w.id), 1)
+}
+
+// Pushes the value built by the LuaTableWriter, nil if the writer fails
+func (L *State) pushTableWriter(w LuaTableWriter) error {
+	err := L.callTableWriter(w)
+	if err != nil {
+		L.PushNil()
+	}
+	return err
+}
+
+// Pushes a value handed to Lua by a Go callback, a failing conversion is raised as a Lua error
+func (L *State) pushResult(val reflect.Value) {
+	if err := goToLua(L, val); err != nil {
+		L.RaiseError(err)
 	}
 }
 
@@ -423,6 +807,27 @@ func (L *State) ExportGoFunction(namedFunc GoExportedFunction) {
 	L.SetGlobal(namedFunc.Name())
 }
 
+// Pushes any Go func as a Lua function. Arguments and results are converted the same
+// way as for methods of pushed structs, variadic funcs take all the remaining arguments
+// and a non nil error returned as the last result follows the error convention.
+func (L *State) PushGoFunc(fn interface{}) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		panic("PushGoFunc can only push a non nil func")
+	}
+	L.pushFunction(&funcInvoker{runtime.FuncForPC(v.Pointer()).Name(), v})
+}
+
+// Exports any Go func as a global Lua function with the given name, see PushGoFunc
+func (L *State) ExportFunc(name string, fn interface{}) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		panic("ExportFunc can only export a non nil func")
+	}
+	L.pushFunction(&funcInvoker{name, v})
+	L.SetGlobal(name)
+}
+
 func (L *State) ExportGoModule(namedMod GoExportedModule) {
 	w := L.newWrapper()
 	w.v = namedMod
@@ -433,23 +838,118 @@ func (L *State) ExportGoModule(namedMod GoExportedModule) {
 	L.SetGlobal(namedMod.Name())
 }
 
+// Pops the value on top of the stack into the registry and returns a reference to it,
+// the value stays alive until the reference is released with Unref
+func (L *State) Ref() int {
+	return int(C.refValue(L.s))
+}
+
+func (L *State) Unref(ref int) {
+	C.unrefValue(L.s, C.int(ref))
+}
+
+// Pushes the value held by the registry reference
+func (L *State) PushRef(ref int) {
+	C.pushRef(L.s, C.int(ref))
+}
+
+// References released by Go finalizers, they are unreferenced the next time
+// the State is used from its own goroutine
+func (L *State) releaseLater(ref int) {
+	L.lock.Lock()
+	L.released_refs = append(L.released_refs, ref)
+	L.lock.Unlock()
+}
+
+func (L *State) unrefReleased() {
+	L.lock.Lock()
+	refs := L.released_refs
+	L.released_refs = nil
+	L.lock.Unlock()
+	for _, ref := range refs {
+		L.Unref(ref)
+	}
+}
+
 func (L *State) ToBoolean(index int) bool {
 	return C.lua_toboolean(L.s, C.int(index)) != 0
 }
 
+// Returns the string value with all of its bytes, a number is converted to a string in place
 func (L *State) ToString(index int) string {
-	str := C.toString(L.s, C.int(index))
-	return C.GoString(str)
+	var l C.size_t
+	str := C.lua_tolstring(L.s, C.int(index), &l)
+	return C.GoStringN(str, C.int(l))
+}
+
+// Like ToString but returns a copy of the bytes, nil if the value is not a string or number
+func (L *State) ToBytes(index int) []byte {
+	var l C.size_t
+	str := C.lua_tolstring(L.s, C.int(index), &l)
+	if str == nil {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(str), C.int(l))
+}
+
+// Returns the value as an integer, 0 if it is not an integer or a float/string with an exact integer value
+func (L *State) ToInteger(index int) int64 {
+	n, _ := L.ToIntegerX(index)
+	return n
 }
 
-func (L *State) ToInteger(index int) int {
-	var i C.int
-	return int(C.lua_tointegerx(L.s, C.int(index), &i))
+// Like ToInteger, ok reports whether the value could be converted
+func (L *State) ToIntegerX(index int) (n int64, ok bool) {
+	var isnum C.int
+	n = int64(C.lua_tointegerx(L.s, C.int(index), &isnum))
+	return n, isnum != 0
 }
 
 func (L *State) ToNumber(index int) float64 {
-	var i C.int
-	return float64(C.lua_tonumberx(L.s, C.int(index), &i))
+	n, _ := L.ToNumberX(index)
+	return n
+}
+
+// Like ToNumber, ok reports whether the value could be converted
+func (L *State) ToNumberX(index int) (n float64, ok bool) {
+	var isnum C.int
+	n = float64(C.lua_tonumberx(L.s, C.int(index), &isnum))
+	return n, isnum != 0
+}
+
+// Reads the number at index as an int64, Lua integers are read as is so no precision is
+// lost, floats are truncated. Values that are not numbers read as 0.
+func (L *State) toInt64(index int) (int64, error) {
+	if n, ok := L.ToIntegerX(index); ok {
+		return n, nil
+	}
+	f, ok := L.ToNumberX(index)
+	if !ok {
+		return 0, nil
+	}
+	if f >= -(1<<63) && f < (1<<63) {
+		return int64(f), nil
+	}
+	return 0, fmt.Errorf("number %g overflows int64", f)
+}
+
+// Like toInt64 for unsigned values, negative numbers are an error. Floats up to 2^64
+// are accepted.
+func (L *State) toUint64(index int) (uint64, error) {
+	if n, ok := L.ToIntegerX(index); ok {
+		if n < 0 {
+			return 0, fmt.Errorf("negative number %d for uint64", n)
+		}
+		return uint64(n), nil
+	}
+	f, ok := L.ToNumberX(index)
+	if !ok {
+		return 0, nil
+	}
+	if f > -1 && f < (1<<64) {
+		return uint64(f), nil
+	}
+	return 0, fmt.Errorf("number %g overflows uint64", f)
 }
 
 func (L *State) ToInterface(index int) interface{} {
@@ -457,8 +957,32 @@ func (L *State) ToInterface(index int) interface{} {
 	id := C.toUserData(L.s, C.int(index))
 	if id > -1 {
 		w := L.obj_table[int64(id)]
-		debug(w.v)
-		return w.v
+		if w != nil {
+			debug(w.v)
+			return w.v
+		}
+	}
+	return nil
+}
+
+// Converts the value at the given index into its natural Go representation
+func (L *State) toGoValue(index int) interface{} {
+	switch L.Type(index) {
+	case C.LUA_TBOOLEAN:
+		return L.ToBoolean(index)
+	case C.LUA_TNUMBER:
+		if C.lua_isinteger(L.s, C.int(index)) != 0 {
+			return L.ToInteger(index)
+		}
+		return L.ToNumber(index)
+	case C.LUA_TSTRING:
+		return L.ToString(index)
+	case C.LUA_TUSERDATA:
+		return L.ToInterface(index)
+	case C.LUA_TFUNCTION:
+		return L.ToFunction(index)
+	case C.LUA_TTABLE:
+		return L.ToTable(index)
 	}
 	return nil
 }
@@ -521,6 +1045,113 @@ func (L *State) GetTable(index int) {
 	C.lua_gettable(L.s, C.int(index))
 }
 
+// Like GetTable without metamethods, returns the type of the pushed value
+func (L *State) RawGet(index int) int {
+	return int(C.lua_rawget(L.s, C.int(index)))
+}
+
+// Like SetTable without metamethods
+func (L *State) RawSet(index int) {
+	C.lua_rawset(L.s, C.int(index))
+}
+
+// Pushes t[n] of the table at index without metamethods, returns the type of the pushed value
+func (L *State) RawGetI(index int, n int64) int {
+	return int(C.lua_rawgeti(L.s, C.int(index), C.lua_Integer(n)))
+}
+
+// Sets t[n] of the table at index to the value on top of the stack, without metamethods
+func (L *State) RawSetI(index int, n int64) {
+	C.lua_rawseti(L.s, C.int(index), C.lua_Integer(n))
+}
+
+// Returns the length of strings and tables and the size of userdata, without metamethods
+func (L *State) RawLen(index int) int {
+	return int(C.lua_rawlen(L.s, C.int(index)))
+}
+
+func (L *State) RawEqual(index1 int, index2 int) bool {
+	return C.lua_rawequal(L.s, C.int(index1), C.int(index2)) == 1
+}
+
+// Pushes the length of the value at index, honoring __len. Nothing is pushed when an
+// error is returned.
+func (L *State) Len(index int) error {
+	L.PushValue(index)
+	return L.callOperator(C.OPERATOR_LEN, 0, 1)
+}
+
+// Calls the operator with the n values on top of the stack, which are popped, and
+// pushes its result. The operators run under pcall as they raise errors on bad operands
+// and metamethods may raise any error, it is returned and nothing is pushed then.
+func (L *State) callOperator(kind C.int, op C.int, n int) error {
+	C.pushOperator(L.s, kind, op)
+	L.Insert(-n - 1)
+	return L.PCall(n, 1)
+}
+
+// Comparison operators for Compare
+type CompareOp int
+
+const (
+	OPEQ = CompareOp(C.LUA_OPEQ)
+	OPLT = CompareOp(C.LUA_OPLT)
+	OPLE = CompareOp(C.LUA_OPLE)
+)
+
+// Compares the two values as the Lua operator would, metamethods included. Reports
+// false if either index is not valid.
+func (L *State) Compare(index1 int, index2 int, op CompareOp) (bool, error) {
+	if L.IsNone(index1) || L.IsNone(index2) {
+		return false, nil
+	}
+	index2 = L.AbsIndex(index2)
+	L.PushValue(index1)
+	L.PushValue(index2)
+	if err := L.callOperator(C.OPERATOR_COMPARE, C.int(op), 2); err != nil {
+		return false, err
+	}
+	ret := L.ToBoolean(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+// Arithmetic operators for Arith
+type ArithOp int
+
+const (
+	OPADD  = ArithOp(C.LUA_OPADD)
+	OPSUB  = ArithOp(C.LUA_OPSUB)
+	OPMUL  = ArithOp(C.LUA_OPMUL)
+	OPMOD  = ArithOp(C.LUA_OPMOD)
+	OPPOW  = ArithOp(C.LUA_OPPOW)
+	OPDIV  = ArithOp(C.LUA_OPDIV)
+	OPIDIV = ArithOp(C.LUA_OPIDIV)
+	OPBAND = ArithOp(C.LUA_OPBAND)
+	OPBOR  = ArithOp(C.LUA_OPBOR)
+	OPBXOR = ArithOp(C.LUA_OPBXOR)
+	OPSHL  = ArithOp(C.LUA_OPSHL)
+	OPSHR  = ArithOp(C.LUA_OPSHR)
+	OPUNM  = ArithOp(C.LUA_OPUNM)
+	OPBNOT = ArithOp(C.LUA_OPBNOT)
+)
+
+// Pops the operands (one for OPUNM and OPBNOT, two otherwise) and pushes the result.
+// The operands are popped and nothing is pushed when an error is returned.
+func (L *State) Arith(op ArithOp) error {
+	n := 2
+	if op == OPUNM || op == OPBNOT {
+		n = 1
+	}
+	return L.callOperator(C.OPERATOR_ARITH, C.int(op), n)
+}
+
+// Pops n values and pushes their concatenation, nothing is pushed when an error is
+// returned
+func (L *State) Concat(n int) error {
+	return L.callOperator(C.OPERATOR_CONCAT, 0, n)
+}
+
 // Stack functions
 func (L *State) SetTop(index int) {
 	C.lua_settop(L.s, C.int(index))
@@ -534,9 +1165,62 @@ func (L *State) GetTop() int {
 	return int(C.lua_gettop(L.s))
 }
 
+// Moves the top element into the given position, shifting up the elements above it
+func (L *State) Insert(index int) {
+	C.lua_rotate(L.s, C.int(index), 1)
+}
+
+// Removes the element at the given position, shifting down the elements above it
+func (L *State) Remove(index int) {
+	C.lua_rotate(L.s, C.int(index), -1)
+	L.Pop(1)
+}
+
+// Pops the top element into the given position
+func (L *State) Replace(index int) {
+	C.lua_copy(L.s, -1, C.int(index))
+	L.Pop(1)
+}
+
+// Rotates the elements between index and the top n positions towards the top
+func (L *State) Rotate(index int, n int) {
+	C.lua_rotate(L.s, C.int(index), C.int(n))
+}
+
+// Copies the element at fromIndex into toIndex, replacing the value there
+func (L *State) Copy(fromIndex int, toIndex int) {
+	C.lua_copy(L.s, C.int(fromIndex), C.int(toIndex))
+}
+
+// Converts a relative index into an absolute one that does not depend on the stack top
+func (L *State) AbsIndex(index int) int {
+	return int(C.lua_absindex(L.s, C.int(index)))
+}
+
+// Makes sure the stack has room for n more elements, false if it can not grow that much
+// Address of a table, function, thread or userdata, used to tell the values apart
+func (L *State) toPointer(idx int) uintptr {
+	return uintptr(C.lua_topointer(L.s, C.int(idx)))
+}
+
+func (L *State) CheckStack(n int) bool {
+	return C.lua_checkstack(L.s, C.int(n)) != 0
+}
+
+// Pops n values from this state and pushes them onto to, both must be threads of the same Lua state
+func (L *State) XMove(to *State, n int) {
+	C.lua_xmove(L.s, to.s, C.int(n))
+}
+
+// Pushes a new full userdata of the given size and returns its address. The memory is
+// owned by Lua and is released when the userdata is collected.
+func (L *State) NewUserdata(size int) unsafe.Pointer {
+	return C.lua_newuserdata(L.s, C.size_t(size))
+}
+
 func (L *State ) ReadFormTable( reader LuaTableReader, idx int) error {
 	if (L.IsTable(idx)) {
-		return reader.FromLUATable(L)
+		return L.callTableReader(reader, idx)
 	}else {
 		err := new(luaError)
 		err.errStr = "Given index is not a LuaTable"
@@ -546,51 +1230,163 @@ func (L *State ) ReadFormTable( reader LuaTableReader, idx int) error {
 
 // Loading the chunk
 func (L *State) LoadCodeString(code string, name string) error {
-	cstr := C.CString(code)
     cname := C.CString(name)
-	err := int(C.loadCodeSegment(L.s, cstr,cname))
+	err := int(C.loadCodeSegment(L.s, (*C.char)(unsafe.Pointer(unsafe.StringData(code))), C.size_t(len(code)), cname))
     
-    C.free(unsafe.Pointer(cstr))
     C.free(unsafe.Pointer(cname))
      
 	if err != 0 {
-		e := new(luaError)
-		e.errStr = L.ToString(-1)
+		e := L.newLuaError(ErrorStatus(err), name)
 		L.Pop(1) /* pop error message from the stack */
 		return e
-	}else {
-		return L.PCall(0, 0)
 	}
-	return nil
+	return L.PCall(0, 0)
 }
 
 func (L *State) PCall(nargs int, nresults int) (err error) {
-	//	defer func() {
-	//		if r := recover(); r != nil {
-	//            var ok bool
-	//            err, ok = r.(error)
-	//            if !ok {
-	//          	   err = fmt.Errorf("Error on lua script %v", r)
-	//            }
-	//         }
-	//	}()
-
+	L.unrefReleased()
 	errval := int(C.callCode(L.s, C.int(nargs), C.int(nresults)))
 	if errval != 0 {
-		errStr := L.ToString(-1)
-		err = fmt.Errorf("Error on lua script --> %s", errStr)
+		err = L.newLuaError(ErrorStatus(errval), "")
 		L.Pop(1) /* pop error message from the stack */
 	}
 
 	return
 }
 
+// Builds a LuaError from the error value on top of the stack, the value is not popped
+func (L *State) newLuaError(status ErrorStatus, chunk string) *LuaError {
+	e := new(LuaError)
+	e.Status = status
+	e.Chunk = chunk
+	e.Value = L.toGoValue(-1)
+	e.cause, _ = e.Value.(error)
+	C.pushErrorString(L.s, -1)
+	e.Message = L.ToString(-1)
+	L.Pop(1)
+	// The message handler only runs for errors raised while running the code
+	if status == ERRRUN || status == ERRERR || status == ERRGCMM {
+		if int(C.pushErrorInfo(L.s)) == C.LUA_TTABLE {
+			L.GetField(-1, "source")
+			if L.IsString(-1) {
+				e.Chunk = strings.TrimLeft(L.ToString(-1), "=@")
+			}
+			L.GetField(-2, "line")
+			e.Line = int(L.ToInteger(-1))
+			L.GetField(-3, "traceback")
+			e.Traceback = L.ToString(-1)
+			L.Pop(3)
+		}
+		L.Pop(1)
+	}
+	if e.Line == 0 {
+		e.positionFromMessage()
+	}
+	return e
+}
+
+// Raises a Lua error with the given message from inside a Go callback. The error is
+// carried back to the C side which raises it once the Go frames have returned, so
+// a call to Error does not return.
 func (L *State) Error(err string) {
 	debug(err)
+	L.pushErrorMessage(err)
+	L.raiseTop(L.ToString(-1))
+}
+
+// Raises err as a Lua error from inside a Go callback. Inside Lua the error is a value
+// whose tostring is the error message, if the script does not catch it PCall returns a
+// LuaError wrapping err. Like Error, a call to RaiseError does not return.
+func (L *State) RaiseError(err error) {
+	L.pushGoError(err)
+	L.raiseTop(err.Error())
+}
+
+// Pops the error value on top of the stack and raises it. The value travels with the
+// panic and catchError pushes it back, so deferred cleanups of the callback may change
+// the stack.
+func (L *State) raiseTop(msg string) {
+	e := &callbackError{msg, refReleased}
+	if L.Type(-1) == TSTRING {
+		L.Pop(1)
+	} else {
+		e.ref = L.Ref()
+	}
+	panic(e)
+}
+
+func (L *State) pushGoError(err error) {
+	w := L.newWrapper()
+	w.v = err
+	w.obj_type = reflect.Interface
+	cstr := C.CString(err.Error())
+	C.pushGoError(L.s, C.longlong(w.id), cstr)
+	C.free(unsafe.Pointer(cstr))
+}
+
+// Pushes the message prefixed with the position of the calling Lua code
+func (L *State) pushErrorMessage(msg string) {
 	C.luaL_where(L.s, 1)
-	pos := L.ToString(-1)
-	L.Pop(1)
-	panic("Error on line " +pos + err)
+	L.PushString(msg)
+	C.lua_concat(L.s, 2)
+}
+
+// Sets a function called with the recovered value and the Go stack whenever a Go callback
+// panics. The panic is turned into a Lua error after the handler returns, a handler that
+// panics itself takes the process down which can be useful in tests.
+func (L *State) SetPanicHandler(handler func(L *State, r interface{}, stack []byte)) {
+	L.panicHandler = handler
+}
+
+// The Lua error raised when a Go callback panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("go panic: %v\n%s", e.Value, e.Stack)
+}
+
+// Carries an error raised with State.Error up to the exported callback, errors that are
+// not plain messages are held in the registry under ref
+type callbackError struct {
+	msg string
+	ref int
+}
+
+// Pushes the error value back for the C side to raise
+func (e *callbackError) push(L *State) {
+	if e.ref == refReleased {
+		L.PushString(e.msg)
+	} else {
+		L.PushRef(e.ref)
+		L.Unref(e.ref)
+	}
+}
+
+func (e *callbackError) Error() string {
+	return e.msg
+}
+
+// Deferred by every exported callback. Turns an error raised in the callback, or a panic,
+// into the status the C side checks before calling lua_error.
+func (L *State) catchError(status *C.int) {
+	if r := recover(); r != nil {
+		if e, ok := r.(*callbackError); ok {
+			e.push(L)
+		} else if e, ok := r.(*LuaError); ok {
+			// Raised by a Lua function called through a Go func value
+			e.pushValue(L)
+		} else {
+			e := &PanicError{r, debug_stack.Stack()}
+			if L.panicHandler != nil {
+				L.panicHandler(L, r, e.Stack)
+			}
+			L.pushGoError(e)
+		}
+		*status = C.GO_LUA_ERROR
+	}
 }
 
 
@@ -624,20 +1420,33 @@ func get_method(val interface{}, lookFor string) (reflect.Value, bool) {
 	}
 }
 
-func goToLua(L *State, val reflect.Value) {
+// The push routine shared by PushInterface, method results and struct fields. It never
+// panics, values it has no native Lua representation for are pushed as proxies. A failing
+// LuaTableWriter and an unsigned value above MaxInt64 are pushed as nil and an error
+// returned.
+func goToLua(L *State, val reflect.Value) error {
 	if !val.IsValid() {
 		L.PushNil()
-		return
+		return nil
 	}
-	t := val.Type()
-	if t.Kind() == reflect.Interface && !val.IsNil() { // unbox interfaces!
-		val = reflect.ValueOf(val.Interface())
-		t = val.Type()
+	kind := val.Kind()
+	switch kind {
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+	}
+	if kind == reflect.Interface { // unbox interfaces!
+		return goToLua(L, val.Elem())
 	}
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
+	if kind == reflect.Ptr && val.Type().Implements(luaValueType) && val.CanInterface() {
+		val.Interface().(luaValue).push()
+		return nil
+	}
+	if w := tableWriter(val); w != nil {
+		return L.pushTableWriter(w)
 	}
-	kind := t.Kind()
 
 	switch kind {
 	case reflect.Float64, reflect.Float32:
@@ -646,11 +1455,17 @@ func goToLua(L *State, val reflect.Value) {
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		{
-			L.PushNumber(float64(val.Int()))
+			L.PushInteger(val.Int())
 		}
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		{
-			L.PushNumber(float64(val.Uint()))
+			// Lua integers are signed, larger values have no exact representation
+			u := val.Uint()
+			if u > math.MaxInt64 {
+				L.PushNil()
+				return fmt.Errorf("lua: %s value %d overflows a lua integer", val.Type(), u)
+			}
+			L.PushInteger(int64(u))
 		}
 	case reflect.String:
 		{
@@ -660,29 +1475,49 @@ func goToLua(L *State, val reflect.Value) {
 		{
 			L.PushBoolean(val.Bool())
 		}
-	case reflect.Slice, reflect.Map, reflect.Struct:
+	case reflect.Func:
 		{
-			if (!val.IsNil()) {
-				debug(" Pushing " + kind.String())
-				L.PushInterface(val.Interface())
+			L.pushFunction(&funcInvoker{runtime.FuncForPC(val.Pointer()).Name(), val})
+		}
+	case reflect.Slice:
+		{
+			if val.Type().Elem().Kind() == reflect.Uint8 {
+				L.PushBytes(val.Bytes())
+			} else if val.CanInterface() {
+				L.pushProxy(val.Interface())
 			} else {
 				L.PushNil()
 			}
 		}
-
 	default:
 		{
-			if val.IsNil() {
-				L.PushNil()
+			// Values read from unexported fields can not be handed out
+			if val.CanInterface() {
+				debug(" Pushing " + kind.String())
+				L.pushProxy(val.Interface())
 			} else {
-				L.PushInterface(val)
+				L.PushNil()
 			}
 		}
 	}
+	return nil
 }
 
-func luaToGo(L *State, val reflect.Value, idx int) {
+// Sets val from the Lua value at idx. Tables are decoded recursively into structs,
+// slices, arrays, maps and interface{} values, an error is returned when the Lua
+// value can not be converted into the type of val.
+func luaToGo(L *State, val reflect.Value, idx int) error {
+	return new(decoder).luaToGo(L, val, idx)
+}
+
+func (d *decoder) luaToGo(L *State, val reflect.Value, idx int) error {
+	idx = L.AbsIndex(idx)
 	kind := val.Kind()
+	if L.strict || d.strict {
+		if ok, err := strictScalar(L, val, idx); ok {
+			return err
+		}
+	}
 
 	switch kind {
 	case reflect.String:
@@ -700,28 +1535,89 @@ func luaToGo(L *State, val reflect.Value, idx int) {
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		{
-			val.SetInt(int64(L.ToNumber(idx)))
+			n, err := L.toInt64(idx)
+			if err != nil {
+				return err
+			}
+			if val.OverflowInt(n) {
+				return fmt.Errorf("number %d overflows %s", n, val.Type())
+			}
+			val.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		{
+			n, err := L.toUint64(idx)
+			if err != nil {
+				return err
+			}
+			if val.OverflowUint(n) {
+				return fmt.Errorf("number %d overflows %s", n, val.Type())
+			}
+			val.SetUint(n)
+		}
+	case reflect.Bool:
+		{
+			val.SetBool(L.ToBoolean(idx))
 		}
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Func:
 		{
-			val.SetUint(uint64(L.ToNumber(idx)))
+			if L.Type(idx) == C.LUA_TFUNCTION {
+				val.Set(L.makeGoFunc(idx, val.Type()))
+			} else {
+				return assignGoValue(L, val, idx)
+			}
+		}
+	case reflect.Struct, reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		{
+			if kind == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 && L.Type(idx) == TSTRING {
+				val.SetBytes(L.ToBytes(idx))
+				return nil
+			}
+			if L.IsTable(idx) && val.Type() != tableType {
+				if reader := tableReader(val); reader != nil {
+					return L.callTableReader(reader, idx)
+				}
+				return d.tableToGo(L, val, idx)
+			}
+			return assignGoValue(L, val, idx)
 		}
-	case reflect.Struct, reflect.Interface, reflect.Ptr:
+	default:
 		{
-			val.Set(reflect.ValueOf(L.ToInterface(idx)))
+			return conversionError(L, idx, val.Type())
 		}
 	}
-	
+	return nil
+}
+
+// Sets val from a Go value held by Lua, a pushed Go object or a Function/Table handle
+func assignGoValue(L *State, val reflect.Value, idx int) error {
+	if L.IsNoneOrNil(idx) {
+		val.Set(reflect.Zero(val.Type()))
+		return nil
+	}
+	v := L.toGoValue(idx)
+	if v != nil {
+		rv := reflect.ValueOf(v)
+		if rv.Type().AssignableTo(val.Type()) {
+			val.Set(rv)
+			return nil
+		} else if rv.Kind() == reflect.Ptr && rv.Elem().Type().AssignableTo(val.Type()) {
+			val.Set(rv.Elem())
+			return nil
+		}
+	}
+	return conversionError(L, idx, val.Type())
 }
 
 /** Exported functions to C**/
 
 //export go_callback_getter
-func go_callback_getter(id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_getter(id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	//	debug ((*wrapper)(obj).isFunction)
 	//To do any reflection we need to figure out the type
 	temState := (*State)(go_sate)
+	defer temState.catchError(&status)
 	p := temState.obj_table[id]
 	//	debug (p)
 	if p.isFunction == 0 {
@@ -740,53 +1636,25 @@ func go_callback_getter(id int64, go_sate unsafe.Pointer) C.int {
 				if temState.IsString(2) {
 					lookFor := temState.ToString(2)
 //					debug("Looking for 1 " + lookFor)
-					
-					fname := get_field_name(p.name, lookFor)
-//					fmt.Println("Field is"+fname)
-					field := itype.FieldByName(fname)
-					
-					//		debug ("Looking for 2"+lookFor)
-					if !field.IsValid() {
-						method_name := get_method_name(p.name,lookFor)
-						_, ok := get_method(val, method_name)
-						temState.SetTop(0)
-						if ok {
-							ic := new(methodInvoker)
-							ic.method = method_name
-							ic.value = val
-							w := temState.newWrapper()
-							w.v = ic
-							w.isFunction = 1
-							w.pointer = 0
-							w.obj_type = reflect.Func
-							temState.SetTop(0)
-							C.pushFunction(temState.s, C.longlong(w.id))
-							ret = 1
-						} else {
-							temState.Error("No method found \"" + lookFor + "\"")
-						}
-					} else {
-						temState.SetTop(0)
-						ret = 1
-						goToLua(temState, field)
+					if !temState.pushStructMember(p, itype, lookFor) {
+						temState.Error("No method found \"" + lookFor + "\"")
 					}
+					ret = 1
 				} else {
-					// Need to find a way to sort this out luaL_error does a longjmp which GO does not like and
-					// Get a split stack panic
-					// Given that GO threads are not based on ptheads its bit dangarous as well for now I am going push nil here
+					// Error does not longjmp from here, the error is raised by go_index once we have returned
 					temState.Error("No valid filed/method specified")
 				}
 			}
-		case reflect.Slice:
+		case reflect.Slice, reflect.Array:
 			{
 				// If this is a slice second argument should be a int
 				if temState.IsNumber(2) {
-					idx := (temState.ToInteger(2) - 1)
+					idx := int(temState.ToInteger(2) - 1)
 					if idx >= 0 && idx < itype.Len() {
 						retVal := itype.Index(idx)
 						temState.SetTop(0)
 						ret = 1
-						goToLua(temState, retVal)
+						temState.pushResult(retVal)
 					} else {
 						temState.SetTop(0)
 						ret = 1
@@ -804,12 +1672,14 @@ func go_callback_getter(id int64, go_sate unsafe.Pointer) C.int {
 				m := itype.Type()
 				kt := m.Key()
 				keyV := reflect.New(kt)
-				luaToGo(temState, keyV.Elem(), 2)
+				if err := luaToGo(temState, keyV.Elem(), 2); err != nil {
+					temState.Error("Invalid map key: " + err.Error())
+				}
 				temState.SetTop(0)
 				ret = 1
 				retVal := itype.MapIndex(keyV.Elem())
 				debug("Key is " + keyV.String())
-				goToLua(temState, retVal)
+				temState.pushResult(retVal)
 			}
 		}
 	} else {
@@ -837,9 +1707,10 @@ func go_callback_getter(id int64, go_sate unsafe.Pointer) C.int {
 }
 
 //export go_callback_setter
-func go_callback_setter(id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_setter(id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	temState := (*State)(go_sate)
+	defer temState.catchError(&status)
 	p := temState.obj_table[id]
 	if p.isFunction != 1 {
 		val := p.v
@@ -857,14 +1728,18 @@ func go_callback_setter(id int64, go_sate unsafe.Pointer) C.int {
 			{
 				if temState.IsString(2) {
 					lookFor := temState.ToString(2)
-					fname := get_field_name(p.name, lookFor)
+					fname := get_field_name(itype.Type(), lookFor)
 					field := itype.FieldByName(fname)
 					if !field.IsValid() || !field.CanSet() {
-						//			temState.Error("No Filed named \"" + lookFor + "\" found")
+						if temState.strict {
+							temState.Error("No field named \"" + lookFor + "\" found")
+						}
 						temState.PushNil()
 					} else {
 						ret = 0
-						luaToGo(temState, field, 3)
+						if err := luaToGo(temState, field, 3); err != nil {
+							temState.Error("Invalid value for field \"" + lookFor + "\": " + err.Error())
+						}
 						temState.SetTop(0)
 					}
 				} else {
@@ -873,11 +1748,15 @@ func go_callback_setter(id int64, go_sate unsafe.Pointer) C.int {
 			}
 		case reflect.Slice:
 			{
-				idx := temState.ToInteger(2) - 1
+				idx := int(temState.ToInteger(2) - 1)
 				newVal := reflect.New(itype.Type().Elem())
-				luaToGo(temState, newVal.Elem(), 3)
-				if idx < 0 || idx > itype.Len() {
-					itype.Index(idx).Set(newVal)
+				if err := luaToGo(temState, newVal.Elem(), 3); err != nil {
+					temState.Error("Invalid slice value: " + err.Error())
+				}
+				if idx >= 0 && idx < itype.Len() {
+					itype.Index(idx).Set(newVal.Elem())
+				} else if temState.strict {
+					temState.Error(fmt.Sprintf("index %d out of range [1, %d]", idx+1, itype.Len()))
 				}
 			}
 		case reflect.Map:
@@ -887,8 +1766,12 @@ func go_callback_setter(id int64, go_sate unsafe.Pointer) C.int {
 				keyV := reflect.New(kt)
 				vt := m.Elem()
 				vV := reflect.New(vt)
-				luaToGo(temState, keyV.Elem(), 2)
-				luaToGo(temState, vV.Elem(), 3)
+				if err := luaToGo(temState, keyV.Elem(), 2); err != nil {
+					temState.Error("Invalid map key: " + err.Error())
+				}
+				if err := luaToGo(temState, vV.Elem(), 3); err != nil {
+					temState.Error("Invalid map value: " + err.Error())
+				}
 				itype.SetMapIndex(keyV.Elem(), vV.Elem())
 			}
 		}
@@ -896,6 +1779,40 @@ func go_callback_setter(id int64, go_sate unsafe.Pointer) C.int {
 	return C.int(ret)
 }
 
+// Pushes the field or the method named lookFor of the struct held by the wrapper.
+// Returns false if there is no such member.
+func (L *State) pushStructMember(p *wrapper, itype reflect.Value, lookFor string) bool {
+	fname := get_field_name(itype.Type(), lookFor)
+	field := itype.FieldByName(fname)
+	if field.IsValid() {
+		L.pushResult(field)
+		return true
+	}
+	method_name := get_method_name(p.name, lookFor)
+	method, ok := get_method(p.v, method_name)
+	if !ok {
+		return false
+	}
+	// The closure is cached on the proxy, later lookups get the same function
+	cname := C.CString(method_name)
+	if C.pushCachedMethod(L.s, C.longlong(p.id), cname) == 0 {
+		ic := new(methodInvoker)
+		ic.method = method_name
+		ic.value = p.v
+		ic.fn = method
+		ic.self = p.id
+		w := L.newWrapper()
+		w.v = ic
+		w.isFunction = 1
+		w.pointer = 0
+		w.obj_type = reflect.Func
+		C.pushFunction(L.s, C.longlong(w.id))
+		C.cacheMethod(L.s, C.longlong(p.id), cname)
+	}
+	C.free(unsafe.Pointer(cname))
+	return true
+}
+
 // Fix the types
 func set_filed_value(v reflect.Value, L *State) {
 	kind := v.Kind()
@@ -908,31 +1825,30 @@ func set_filed_value(v reflect.Value, L *State) {
 }
 
 //export go_callback_method
-func go_callback_method(id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_method(id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	temState := (*State)(go_sate)
+	defer temState.catchError(&status)
 	p := temState.obj_table[id]
+	if p == nil {
+		temState.Error("Go function has already been released")
+	}
 	if p.isFunction == 1 {
 		f := p.v.(GOLuaFunction)
 		debug("f : ")
 		debug(f)
 		debug("\n")
 		ret = f.Invoke(temState)
-		a,ok := f.(*methodInvoker) // Methods invoked does not need to stay in memory
-		if ok {
-//			fmt.Printf("%d : %v \n", p.id, a.method )
-			a.value = nil	
-			delete(temState.obj_table, p.id)
-		}
 	}
 	return C.int(ret)
 }
 
 //export go_callback_len
-func go_callback_len (id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_len (id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	ret = 1
 	temState := (*State)(go_sate)
+	defer temState.catchError(&status)
 	temState.SetTop(0)
 	p := temState.obj_table[id]
 	if p.isFunction == 0 {
@@ -943,11 +1859,11 @@ func go_callback_len (id int64, go_sate unsafe.Pointer) C.int {
 			val = reflect.ValueOf(p.v)
 		}
 		switch p.obj_type {
-			case reflect.Slice, reflect.Map: {
-				temState.PushInteger(val.Len())
+			case reflect.Slice, reflect.Array, reflect.Map: {
+				temState.PushInteger(int64(val.Len()))
 			}
 			case reflect.Struct: {
-				temState.PushInteger(val.NumField())
+				temState.PushInteger(int64(len(struct_lua_names(temState, val.Type()))))
 			}
 			default :{
 				temState.PushInteger(0)
@@ -964,6 +1880,20 @@ type loopStruct struct {
 	pointer    	int
 	ip_pairs    int
 	current_idx int
+	// Wrapper of the object looped over
+	id          int64
+	// Keys of a map taken when the loop starts
+	keys        []reflect.Value
+}
+
+// Keys of the map are taken once when pairs is called so every key is visited exactly
+// once. Keys removed by the script during the loop are skipped and keys added are not
+// visited, as with Lua tables.
+func (p *loopStruct) snapshotKeys(L *State, val reflect.Value) {
+	p.keys = val.MapKeys()
+	if L.sortMapKeys {
+		sortMapKeys(p.keys)
+	}
 }
 
 func (p *loopStruct) Invoke(L *State) int {
@@ -976,55 +1906,55 @@ func (p *loopStruct) Invoke(L *State) int {
 		}
 		pairs := p.ip_pairs == 0
 		switch p.obj_type {
-			case reflect.Slice, reflect.Map: {
-				max := val.Len()
-				var retVal reflect.Value
-				current_idx := 0
-				current_idx = p.current_idx
-				
-				if current_idx >= max {
+			case reflect.Slice, reflect.Array: {
+				current_idx := p.current_idx
+				if !pairs {
+					// ipairs passes the last index as the control variable
+					current_idx = int(L.ToInteger(2))
+				}
+				if current_idx >= val.Len() {
 					L.PushNil()
-				}else {
-					if p.obj_type == reflect.Slice {
-						retVal = val.Index(current_idx)
-						L.PushInteger((current_idx + 1))
-					}else {
-						k := val.MapKeys()[current_idx]
-						if (pairs) {
-							goToLua(L, k)
-						}else {
-							L.PushInteger(current_idx)
-						}
-						retVal = val.MapIndex(k)
+				} else {
+					L.PushInteger(int64(current_idx + 1))
+					L.pushResult(val.Index(current_idx))
+					p.current_idx = current_idx + 1
+					ret = 2
+				}
+			}
+			case reflect.Map: {
+				L.PushNil()
+				for p.current_idx < len(p.keys) {
+					k := p.keys[p.current_idx]
+					p.current_idx ++
+					v := val.MapIndex(k)
+					if v.IsValid() {
+						L.Pop(1)
+						L.pushResult(k)
+						L.pushResult(v)
+						ret = 2
+						break
 					}
 				}
-				current_idx ++
-				p.current_idx = current_idx
-				goToLua(L, retVal)
-				ret = 2
 			}
 			case reflect.Struct: {
-				max := val.NumField() 
-				current_idx := 0
-				if (!pairs) {
-					current_idx = L.ToInteger(2)
-				}else {
-					current_idx = p.current_idx
+				// The same names the getter accepts so obj[k] gives back v
+				w := L.obj_table[p.id]
+				if w == nil {
+					L.Error("Go object has already been released")
 				}
-				
-				if current_idx >= max {
-					L.PushNil()
-				} else {
-					f := val.Field(current_idx)
-					current_idx ++
-					p.current_idx = current_idx
-					if (pairs) {
-						L.PushString(val.Type().Field(current_idx-1).Name)
-					}else {
-						L.PushInteger(current_idx)
+				names := struct_lua_names(L, val.Type())
+				for ret == 1 && p.current_idx < len(names) {
+					name := names[p.current_idx]
+					p.current_idx ++
+					L.PushString(name)
+					if L.pushStructMember(w, val, name) {
+						ret = 2
+					} else {
+						L.Pop(1)
 					}
-					goToLua(L, f)
-					ret = 2
+				}
+				if ret == 1 {
+					L.PushNil()
 				}
 			}
 			default :{
@@ -1044,11 +1974,13 @@ func clone_wrapper (L *State , ori *wrapper) *wrapper {
 }
 
 //export go_callback_pairs
-func go_callback_pairs (id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_pairs (id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	ret = 2
 	temState := (*State)(go_sate)
-	temState.SetTop(0)
+	defer temState.catchError(&status)
+	// Keep the proxy, it is handed back as the state of the loop
+	temState.SetTop(1)
 	p := temState.obj_table[id]
 	if p.isFunction == 0 {
 		loop := new (loopStruct)
@@ -1056,10 +1988,20 @@ func go_callback_pairs (id int64, go_sate unsafe.Pointer) C.int {
 		loop.pointer = p.pointer
 		loop.current_idx = 0
 		loop.obj_type = p.obj_type
+		loop.id = p.id
+		if p.obj_type == reflect.Map {
+			var val reflect.Value
+			if p.pointer == 1 {
+				val = reflect.ValueOf(p.v).Elem()
+			} else {
+				val = reflect.ValueOf(p.v)
+			}
+			loop.snapshotKeys(temState, val)
+		}
 		temState.pushFunction(loop)
 		loop.ip_pairs = 0
-//		p = clone_wrapper(temState,p)
-		C.pushObject(temState.s, C.longlong(p.id), 1)
+		// A second userdata for the same wrapper would release it when collected
+		temState.PushValue(1)
 		temState.PushNil()
 		ret = 3
 	}
@@ -1067,13 +2009,18 @@ func go_callback_pairs (id int64, go_sate unsafe.Pointer) C.int {
 }
 
 //export go_callback_ipairs
-func go_callback_ipairs (id int64, go_sate unsafe.Pointer) C.int {
+func go_callback_ipairs (id int64, go_sate unsafe.Pointer) (status C.int) {
 	var ret int
 	ret = 1
 	temState := (*State)(go_sate)
-	temState.SetTop(0)
+	defer temState.catchError(&status)
+	temState.SetTop(1)
 	p := temState.obj_table[id]
 	if p.isFunction == 0 {
+		// Only sequences have an order to walk in
+		if p.obj_type != reflect.Slice && p.obj_type != reflect.Array {
+			temState.Error(fmt.Sprintf("ipairs needs a Go slice or array, got %s (use pairs)", p.obj_type))
+		}
 		loop := new (loopStruct)
 		loop.v = p.v
 		loop.pointer = p.pointer
@@ -1081,8 +2028,8 @@ func go_callback_ipairs (id int64, go_sate unsafe.Pointer) C.int {
 		loop.obj_type = p.obj_type
 		temState.pushFunction(loop)
 		loop.ip_pairs = 1
-//		p = clone_wrapper(temState,p)
-		C.pushObject(temState.s, C.longlong(p.id), 1)
+		// A second userdata for the same wrapper would release it when collected
+		temState.PushValue(1)
 		temState.PushInteger(0)
 		ret = 3
 	}
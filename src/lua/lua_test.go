@@ -0,0 +1,134 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestState(t *testing.T) *State {
+	L, err := NewState(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(L.Close)
+	return L
+}
+
+func run(t *testing.T, L *State, code string) {
+	t.Helper()
+	if err := L.LoadCodeString(code, "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func globalString(t *testing.T, L *State, name string) string {
+	t.Helper()
+	s, err := GetGlobalAs[string](L, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var errBoom = errors.New("boom")
+
+type account struct {
+	Name    string `json:"name"`
+	Balance int64
+	Base
+	secret string
+}
+
+type Base struct {
+	ID int
+}
+
+func (a *account) Fail() error {
+	return errBoom
+}
+
+func (a *account) Deposit(n int64) (int64, error) {
+	if n < 0 {
+		return 0, errors.New("negative deposit")
+	}
+	a.Balance += n
+	return a.Balance, nil
+}
+
+func pushGlobal(t *testing.T, L *State, name string, v interface{}) {
+	t.Helper()
+	if err := L.PushInterface(v); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal(name)
+}
+
+func TestPCallAroundFailingGoMethod(t *testing.T) {
+	L := newTestState(t)
+	pushGlobal(t, L, "acc", &account{Name: "a"})
+	run(t, L, `
+		local ok, err = pcall(function() return acc:Fail() end)
+		result = tostring(ok) .. " " .. tostring(err)
+		local n = acc:Deposit(5)
+		after = tostring(n)`)
+	if got := globalString(t, L, "result"); got != "false boom" {
+		t.Errorf("pcall result = %q", got)
+	}
+	if got := globalString(t, L, "after"); got != "5" {
+		t.Errorf("state after caught error = %q", got)
+	}
+
+	err := L.LoadCodeString("acc:Fail()", "uncaught")
+	if !errors.Is(err, errBoom) || !errors.Is(err, ERRRUN) {
+		t.Fatalf("uncaught error = %v, want to wrap errBoom with ERRRUN", err)
+	}
+	var lerr *LuaError
+	if !errors.As(err, &lerr) || lerr.Line != 1 || lerr.Chunk == "" {
+		t.Errorf("error position = %+v", lerr)
+	}
+}
+
+// Raises an argument error while Table.ForEach has a deferred SetTop pending
+type checkEntries struct{}
+
+func (c *checkEntries) Name() string {
+	return "checkEntries"
+}
+
+func (c *checkEntries) Invoke(L *State) int {
+	L.CheckTable(1).ForEach(func(k, v interface{}) error {
+		if _, ok := v.(string); !ok {
+			L.ArgError(1, "bad entry")
+		}
+		return nil
+	})
+	return 0
+}
+
+func TestErrorRaisedUnderDeferredCleanup(t *testing.T) {
+	L := newTestState(t)
+	L.ExportGoFunction(new(checkEntries))
+	run(t, L, `
+		local ok, err = pcall(checkEntries, {1})
+		result = err`)
+	if got := globalString(t, L, "result"); !strings.Contains(got, "bad entry") {
+		t.Errorf("error = %q, want the argument error", got)
+	}
+}
@@ -17,13 +17,17 @@
 
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 
 #include "luanative.h"
 #include "_cgo_export.h"
 
 #define GO_LUA_OBJECT		"buksy.go.lua.obj"
 #define GO_LUA_FUNC			"buksy.go.lua.func"
+#define GO_LUA_ERROR_VALUE	"buksy.go.lua.error"
 #define GO_SATE 	  		"buksy.go.state"
+#define GO_ERROR_INFO		"buksy.go.errinfo"
+#define GO_METHOD_CACHE		"buksy.go.methods"
 
 typedef struct GoObject {
 	long long go;
@@ -94,25 +98,76 @@ void openDefaultLib (lua_State *L,  int openlib) {
 	luaL_requiref(L, libname, openfunc, 1);
 }
 
+static int error_to_string(lua_State *L) {
+	luaL_tolstring(L, 1, NULL);
+	return 1;
+}
+
+/*
+ * Pushes the error value at idx as a string. A __tostring metamethod is script code
+ * that can fail, it runs under lua_pcall so a bad error value can not raise again.
+ */
+void pushErrorString(lua_State *L, int idx) {
+	idx = lua_absindex(L, idx);
+	lua_pushcfunction(L, error_to_string);
+	lua_pushvalue(L, idx);
+	if (lua_pcall(L, 1, 1, 0) != LUA_OK || !lua_isstring(L, -1)) {
+		lua_pop(L, 1);
+		lua_pushfstring(L, "(error object is a %s value)", luaL_typename(L, idx));
+	}
+}
+
+/*
+ * Message handler used by callCode. It leaves the original error value untouched
+ * (so Go can still see it) and records where the error happened together with a
+ * full traceback in the registry, from where PCall picks it up.
+ */
+static int msg_handler(lua_State *L) {
+	lua_Debug ar;
+	int level;
+	const char *msg;
+
+	lua_createtable(L, 0, 3);
+	// Level 1 could be a C function such as error(), look for the first Lua frame
+	for (level = 1; lua_getstack(L, level, &ar); level++) {
+		lua_getinfo(L, "Sl", &ar);
+		if (ar.currentline > 0) {
+			lua_pushstring(L, ar.source);
+			lua_setfield(L, -2, "source");
+			lua_pushinteger(L, ar.currentline);
+			lua_setfield(L, -2, "line");
+			break;
+		}
+	}
+	pushErrorString(L, 1);
+	msg = lua_tostring(L, -1);
+	luaL_traceback(L, L, msg, 1);
+	lua_setfield(L, -3, "traceback");
+	lua_pop(L, 1);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_ERROR_INFO);
+	lua_settop(L, 1);
+	return 1;
+}
+
 int callCode (lua_State *L , int nargs, int retargs) {
-//	try {
-		int ret = lua_pcall(L, nargs, retargs, 0);
-		return ret;
-//	}catch(...) {
-//		return -1;
-//	}
+	int base = lua_gettop(L) - nargs;
+	int ret;
+
+	lua_pushnil(L);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_ERROR_INFO);
+	lua_pushcfunction(L, msg_handler);
+	lua_insert(L, base);
+	ret = lua_pcall(L, nargs, retargs, base);
+	lua_remove(L, base);
+	return ret;
 }
 
-const char *toString (lua_State *L , int idx) {
-//	const char *ret = lua_tostring(L, idx);
-//	if (ret) {
-//		return strdup(ret);
-//	}
-	return lua_tostring(L, idx);;
+int pushErrorInfo (lua_State *L) {
+	return lua_getfield(L, LUA_REGISTRYINDEX, GO_ERROR_INFO);
 }
 
-int loadCodeSegment(lua_State *L, const char *code, const char *name) {
-	return luaL_loadbuffer (L, code, strlen(code), name);
+int loadCodeSegment(lua_State *L, const char *code, size_t len, const char *name) {
+	return luaL_loadbuffer (L, code, len, name);
 }
 
 void pushObject(lua_State *L, long long obj, int add_meta_table) {
@@ -127,13 +182,24 @@ void pushObject(lua_State *L, long long obj, int add_meta_table) {
 	}
 }
 
+/*
+ * The Go callbacks can not raise errors themselves, lua_error would longjmp over the
+ * Go frames. They leave the error value on the stack and return GO_LUA_ERROR instead.
+ */
+static int check_go_error(lua_State *L, int ret) {
+	if (ret == GO_LUA_ERROR) {
+		return lua_error(L);
+	}
+	return ret;
+}
+
 static int func_invoker(lua_State *L) {
 //	fprintf(stderr, "my_call -->1 %d\n %p\n",lua_gettop(L), lua_touserdata(L, 1));
 	GoObject *obj = lua_touserdata(L, lua_upvalueindex(1));
 	GoObject *go_sate = get_go_state(L);
 //	fprintf(stderr, "my_call -->2 %d\n %p : %p\1 \n",lua_gettop(L), obj, lua_touserdata(L, 1));
 	int ret = go_callback_method(obj->go, go_sate->state);
-	return ret;
+	return check_go_error(L, ret);
 }
 
 void pushFunction(lua_State *L, long long obj) {
@@ -152,6 +218,20 @@ static int gc_goobj (lua_State * L) {
 	GoObject *go_sate = get_go_state(L);
 	GoObject *obj = (GoObject *) luaL_checkudata (L, 1, GO_LUA_OBJECT);
 //	fprintf(stderr, "gc called\n");
+	if (obj) {
+		go_cleanup (obj->go, go_sate->state);
+		// Drop the methods cached for the proxy
+		lua_getfield(L, LUA_REGISTRYINDEX, GO_METHOD_CACHE);
+		lua_pushnil(L);
+		lua_rawseti(L, -2, obj->go);
+		obj->go = -1;
+	}
+	return 0;
+}
+
+static int gc_goerror (lua_State * L) {
+	GoObject *go_sate = get_go_state(L);
+	GoObject *obj = (GoObject *) luaL_checkudata (L, 1, GO_LUA_ERROR_VALUE);
 	if (obj) {
 		go_cleanup (obj->go, go_sate->state);
 		obj->go = -1;
@@ -159,6 +239,22 @@ static int gc_goobj (lua_State * L) {
 	return 0;
 }
 
+/* The message of a Go error is kept as the user value of the error userdata */
+static int go_error_tostring (lua_State * L) {
+	luaL_checkudata (L, 1, GO_LUA_ERROR_VALUE);
+	lua_getuservalue(L, 1);
+	return 1;
+}
+
+void pushGoError(lua_State *L, long long obj, const char *msg) {
+	GoObject *o = lua_newuserdata (L, sizeof(GoObject));
+	o->go = obj;
+	o->name = "error";
+	lua_pushstring(L, msg);
+	lua_setuservalue(L, -2);
+	luaL_setmetatable(L, GO_LUA_ERROR_VALUE);
+}
+
 static int go_index (lua_State * L) {
 
 	GoObject *go_sate = get_go_state(L);
@@ -169,7 +265,7 @@ static int go_index (lua_State * L) {
 //		fprintf(stderr, "go_index Looking for %s\n",toString(L, 2));
 		ret = go_callback_getter(obj->go, go_sate->state);
 	}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 static int go_new_index (lua_State * L) {
@@ -182,7 +278,7 @@ static int go_new_index (lua_State * L) {
 //		fprintf(stderr, " go_new_index Looking for %s\n",toString(L, 2));
 		ret = go_callback_setter(obj->go, go_sate->state);
 	}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 static int go_len (lua_State * L) {
@@ -193,7 +289,7 @@ static int go_len (lua_State * L) {
 		if (obj) {
 			ret = go_callback_len(obj->go, go_sate->state);
 		}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 static int go_pairs (lua_State * L) {
@@ -204,7 +300,7 @@ static int go_pairs (lua_State * L) {
 	if (obj) {
 		ret = go_callback_pairs(obj->go, go_sate->state);
 	}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 static int go_ipairs (lua_State * L) {
@@ -215,7 +311,7 @@ static int go_ipairs (lua_State * L) {
 	if (obj) {
 		ret = go_callback_ipairs(obj->go, go_sate->state);
 	}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 static int go_call (lua_State * L) {
@@ -230,7 +326,7 @@ static int go_call (lua_State * L) {
 		lua_remove(L,1);
 		ret = go_callback_method(obj->go, go_sate->state);
 	}
-	return ret;
+	return check_go_error(L, ret);
 }
 
 void addDefaultGC(lua_State *L) {
@@ -254,6 +350,10 @@ void initNewState(lua_State *L, void *go_stae) {
 	lua_setmetatable(L, -2);
 	lua_setfield(L, LUA_REGISTRYINDEX, GO_SATE);
 
+	// Cache of method closures, see pushCachedMethod
+	lua_newtable(L);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_METHOD_CACHE);
+
 	// Meta table for struct
 	luaL_newmetatable(L, GO_LUA_OBJECT);
 	lua_pushboolean(L, 0);
@@ -281,6 +381,18 @@ void initNewState(lua_State *L, void *go_stae) {
 	lua_setfield(L, -2, "__newindex");
 
 
+	// Meta table for Go errors raised as Lua errors
+	luaL_newmetatable(L, GO_LUA_ERROR_VALUE);
+	lua_pushboolean(L, 0);
+	lua_setfield(L, -2, "__metatable");
+
+	lua_pushcfunction(L, gc_goerror);
+	lua_setfield(L, -2, "__gc");
+
+	lua_pushcfunction(L, go_error_tostring);
+	lua_setfield(L, -2, "__tostring");
+	lua_pop(L, 1);
+
 	// Meta table for FUNC
 //	luaL_newmetatable(L, GO_LUA_FUNC);
 //	lua_pushboolean(L, 0);
@@ -298,15 +410,193 @@ void deinitState(lua_State *L ) {
 //	lua_setfield(L, LUA_REGISTRYINDEX, GO_SATE);
 }
 
-void doLuaError (lua_State *L, const char * errorMsg){
-//	lua_getglobal(L, "error");
-//	lua_pushstring(L, errorMsg);
-//	lua_pcall(L, 1,1,0);
-	luaL_error(L, errorMsg);
+/*
+ * Pushes the message luaL_argerror would raise, the Go side raises it once the
+ * Go callback has returned
+ */
+void pushArgError(lua_State *L, int arg, const char *extramsg) {
+	lua_Debug ar;
+
+	if (!lua_getstack(L, 0, &ar)) {
+		lua_pushfstring(L, "bad argument #%d (%s)", arg, extramsg);
+		return;
+	}
+	lua_getinfo(L, "n", &ar);
+	luaL_where(L, 1);
+	if (ar.namewhat != NULL && strcmp(ar.namewhat, "method") == 0) {
+		arg--;
+		if (arg == 0) {
+			lua_pushfstring(L, "calling '%s' on bad self (%s)", ar.name, extramsg);
+			lua_concat(L, 2);
+			return;
+		}
+	}
+	lua_pushfstring(L, "bad argument #%d to '%s' (%s)", arg, ar.name ? ar.name : "?", extramsg);
+	lua_concat(L, 2);
+}
+
+/* Looks up the path given as one argument per part, starting from the globals */
+static int get_path(lua_State *L) {
+	int n = lua_gettop(L);
+	int i;
+
+	luaL_checkstack(L, n + 1, "path too long");
+	lua_pushglobaltable(L);
+	for (i = 1; i <= n; i++) {
+		int t = lua_type(L, -1);
+		if (t != LUA_TTABLE && t != LUA_TUSERDATA) {
+			lua_pushnil(L);
+			return 1;
+		}
+		lua_getfield(L, -1, lua_tostring(L, i));
+	}
+	return 1;
+}
+
+void pushPathGetter(lua_State *L) {
+	lua_pushcfunction(L, get_path);
+}
+
+/*
+ * Sets the value given as the last argument at the path given as one argument per
+ * part, creating the missing tables along the way
+ */
+static int set_path(lua_State *L) {
+	int n = lua_gettop(L) - 1;
+	int i;
+
+	lua_pushglobaltable(L);
+	for (i = 1; i < n; i++) {
+		int t = lua_getfield(L, -1, lua_tostring(L, i));
+		if (t == LUA_TNIL) {
+			lua_pop(L, 1);
+			lua_newtable(L);
+			lua_pushvalue(L, -1);
+			lua_setfield(L, -3, lua_tostring(L, i));
+		} else if (t != LUA_TTABLE && t != LUA_TUSERDATA) {
+			return luaL_error(L, "'%s' is a %s value, not a table", lua_tostring(L, i), luaL_typename(L, -1));
+		}
+		lua_remove(L, -2);
+	}
+	lua_pushvalue(L, n + 1);
+	lua_setfield(L, -2, lua_tostring(L, n));
+	return 0;
+}
+
+void pushPathSetter(lua_State *L) {
+	lua_pushcfunction(L, set_path);
+}
+
+/*
+ * Table access of the Go Table handle, called under lua_pcall as metamethods and
+ * luaL_len can raise errors. Takes the table and the key and value the op needs.
+ */
+static int table_access(lua_State *L) {
+	switch (lua_tointeger(L, lua_upvalueindex(1))) {
+	case TABLE_GET:
+		lua_gettable(L, 1);
+		return 1;
+	case TABLE_RAWGET:
+		lua_rawget(L, 1);
+		return 1;
+	case TABLE_SET:
+		lua_settable(L, 1);
+		return 0;
+	case TABLE_RAWSET:
+		lua_rawset(L, 1);
+		return 0;
+	case TABLE_LEN:
+		lua_pushinteger(L, luaL_len(L, 1));
+		return 1;
+	}
+	return 0;
+}
+
+void pushTableAccess(lua_State *L, int op) {
+	lua_pushinteger(L, op);
+	lua_pushcclosure(L, table_access, 1);
+}
+
+/*
+ * The Lua operators of State.Compare, Arith, Concat and Len, called under lua_pcall as
+ * metamethods and the operators themselves can raise errors. Takes the operands.
+ */
+static int operator(lua_State *L) {
+	int op = lua_tointeger(L, lua_upvalueindex(2));
+	switch (lua_tointeger(L, lua_upvalueindex(1))) {
+	case OPERATOR_COMPARE:
+		lua_pushboolean(L, lua_compare(L, 1, 2, op));
+		return 1;
+	case OPERATOR_ARITH:
+		lua_arith(L, op);
+		return 1;
+	case OPERATOR_CONCAT:
+		lua_concat(L, lua_gettop(L));
+		return 1;
+	case OPERATOR_LEN:
+		lua_len(L, 1);
+		return 1;
+	}
+	return 0;
+}
+
+void pushOperator(lua_State *L, int kind, int op) {
+	lua_pushinteger(L, kind);
+	lua_pushinteger(L, op);
+	lua_pushcclosure(L, operator, 2);
+}
+
+/*
+ * Method closures are cached per proxy in a registry table, indexed by the wrapper id
+ * of the proxy and the method name. The entry is dropped when the proxy is collected.
+ */
+int pushCachedMethod(lua_State *L, long long id, const char *name) {
+	int top = lua_gettop(L);
+
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_METHOD_CACHE);
+	if (lua_rawgeti(L, -1, id) == LUA_TTABLE) {
+		lua_getfield(L, -1, name);
+		if (lua_isfunction(L, -1)) {
+			lua_replace(L, top + 1);
+			lua_settop(L, top + 1);
+			return 1;
+		}
+	}
+	lua_settop(L, top);
+	return 0;
+}
+
+/* Caches the closure on top of the stack, it is left on the stack */
+void cacheMethod(lua_State *L, long long id, const char *name) {
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_METHOD_CACHE);
+	if (lua_rawgeti(L, -1, id) != LUA_TTABLE) {
+		lua_pop(L, 1);
+		lua_newtable(L);
+		lua_pushvalue(L, -1);
+		lua_rawseti(L, -3, id);
+	}
+	lua_pushvalue(L, -3);
+	lua_setfield(L, -2, name);
+	lua_pop(L, 2);
+}
+
+int refValue(lua_State *L) {
+	return luaL_ref(L, LUA_REGISTRYINDEX);
+}
+
+void unrefValue(lua_State *L, int ref) {
+	luaL_unref(L, LUA_REGISTRYINDEX, ref);
+}
+
+void pushRef(lua_State *L, int ref) {
+	lua_rawgeti(L, LUA_REGISTRYINDEX, ref);
 }
 
 long long toUserData(lua_State *L, int idx) {
-	GoObject *obj = (GoObject *) lua_touserdata (L, idx);
+	GoObject *obj = (GoObject *) luaL_testudata (L, idx, GO_LUA_OBJECT);
+	if (!obj) {
+		obj = (GoObject *) luaL_testudata (L, idx, GO_LUA_ERROR_VALUE);
+	}
 //	fprintf(stderr, " user data %p %d %s\n", obj, lua_isuserdata(L, idx), lua_typename(L, idx));
 	if (obj) {
 //		fprintf(stderr, " user data %p\n", obj);
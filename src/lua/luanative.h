@@ -22,25 +22,63 @@
 #include <lauxlib.h>
 #include <lualib.h>
 
+/* Returned by the Go callbacks when they have left an error value on top of the stack */
+#define GO_LUA_ERROR -1
+
 void openDefaultLib (lua_State *L,  int openlib);
 
 int callCode (lua_State *L , int nargs, int retargs);
 
-const char *toString (lua_State *L , int idx);
+void pushErrorString(lua_State *L, int idx);
+
+int pushErrorInfo (lua_State *L);
 
-int loadCodeSegment(lua_State *L, const char *code, const char *name);
+int loadCodeSegment(lua_State *L, const char *code, size_t len, const char *name);
 
 void pushObject(lua_State *L, long long obj, int add_meta_table) ;
 
 void pushFunction(lua_State *L, long long obj) ;
 
+void pushGoError(lua_State *L, long long obj, const char *msg);
+
 void initNewState(lua_State *L, void *go_stae) ;
 
 void deinitState (lua_State *L);
 
-void doLuaError (lua_State *L, const char * errorMsg);
-
 void addDefaultGC(lua_State *L);
 
 long long toUserData(lua_State *L, int idx) ;
+
+void pushArgError(lua_State *L, int arg, const char *extramsg);
+
+void pushPathGetter(lua_State *L);
+
+void pushPathSetter(lua_State *L);
+
+/* Operations of pushTableAccess */
+#define TABLE_GET	0
+#define TABLE_RAWGET	1
+#define TABLE_SET	2
+#define TABLE_RAWSET	3
+#define TABLE_LEN	4
+
+void pushTableAccess(lua_State *L, int op);
+
+/* Operators of pushOperator */
+#define OPERATOR_COMPARE	0
+#define OPERATOR_ARITH	1
+#define OPERATOR_CONCAT	2
+#define OPERATOR_LEN	3
+
+void pushOperator(lua_State *L, int kind, int op);
+
+int pushCachedMethod(lua_State *L, long long id, const char *name);
+
+void cacheMethod(lua_State *L, long long id, const char *name);
+
+int refValue(lua_State *L);
+
+void unrefValue(lua_State *L, int ref);
+
+void pushRef(lua_State *L, int ref);
 #endif
@@ -0,0 +1,212 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+/*
+#include "luanative.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Pushes v as plain Lua values. Unlike PushInterface, which pushes a proxy to the Go
+// value, structs, slices, arrays and maps are copied into new tables so the script
+// works on a snapshot of the data. Struct fields are named by their lua tag, or json
+// tag when they have none, lua:"-" skips a field and omitempty skips zero values.
+// Nothing is pushed when an error is returned.
+func Marshal(L *State, v interface{}) error {
+	top := L.GetTop()
+	if err := marshalValue(L, reflect.ValueOf(v), make(map[visitKey]bool)); err != nil {
+		L.SetTop(top)
+		return err
+	}
+	return nil
+}
+
+// Fills the value v points to from the Lua value at idx. Tables are decoded the same way
+// Marshal encodes them, fields are matched by lua tag, json tag or upper cased name.
+func Unmarshal(L *State, idx int, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("lua: Unmarshal needs a non nil pointer")
+	}
+	d := &decoder{marshalNames: true}
+	return d.luaToGo(L, rv.Elem(), idx)
+}
+
+// A pointer, map or slice on the current path. The type and the length tell apart
+// values that share an address, such as a struct and its first field or a slice and a
+// shorter slice of the same array.
+type visitKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// Marks val as being marshaled, fails if it already is as the value contains itself
+func enterValue(val reflect.Value, visiting map[visitKey]bool) (visitKey, error) {
+	key := visitKey{val.Pointer(), val.Type(), 0}
+	if val.Kind() == reflect.Slice {
+		key.len = val.Len()
+	}
+	if visiting[key] {
+		return key, fmt.Errorf("lua: cannot marshal cyclic value of type %s", val.Type())
+	}
+	visiting[key] = true
+	return key, nil
+}
+
+// Every level of nesting keeps its table on the stack and pushes a key and a value
+const marshalStackSlots = 3
+
+// visiting holds the pointers, maps and slices on the current path, to fail on cycles
+// instead of recursing forever
+func marshalValue(L *State, val reflect.Value, visiting map[visitKey]bool) error {
+	if !val.IsValid() {
+		L.PushNil()
+		return nil
+	}
+	if !L.CheckStack(marshalStackSlots) {
+		return fmt.Errorf("lua: cannot marshal %s, nested too deeply", val.Type())
+	}
+	if w := tableWriter(val); w != nil {
+		return L.callTableWriter(w)
+	}
+	switch val.Kind() {
+	case reflect.Interface:
+		if val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		return marshalValue(L, val.Elem(), visiting)
+	case reflect.Ptr:
+		if val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		if val.Type().Implements(luaValueType) {
+			return goToLua(L, val)
+		}
+		key, err := enterValue(val, visiting)
+		if err != nil {
+			return err
+		}
+		err = marshalValue(L, val.Elem(), visiting)
+		delete(visiting, key)
+		return err
+	case reflect.Struct:
+		C.lua_createtable(L.s, 0, C.int(val.NumField()))
+		return marshalStruct(L, val, visiting)
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
+			L.PushBytes(val.Bytes())
+			return nil
+		}
+		if val.Kind() == reflect.Slice && val.Len() > 0 {
+			key, err := enterValue(val, visiting)
+			if err != nil {
+				return err
+			}
+			defer delete(visiting, key)
+		}
+		C.lua_createtable(L.s, C.int(val.Len()), 0)
+		for i := 0; i < val.Len(); i++ {
+			if err := marshalValue(L, val.Index(i), visiting); err != nil {
+				return err
+			}
+			L.RawSetI(-2, int64(i+1))
+		}
+	case reflect.Map:
+		if val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		key, err := enterValue(val, visiting)
+		if err != nil {
+			return err
+		}
+		defer delete(visiting, key)
+		C.lua_createtable(L.s, 0, C.int(val.Len()))
+		iter := val.MapRange()
+		for iter.Next() {
+			if err := marshalValue(L, iter.Key(), visiting); err != nil {
+				return err
+			}
+			if L.IsNil(-1) {
+				return fmt.Errorf("lua: cannot marshal nil map key of type %s", val.Type())
+			}
+			if err := marshalValue(L, iter.Value(), visiting); err != nil {
+				return err
+			}
+			L.RawSet(-3)
+		}
+	case reflect.Func:
+		if val.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		L.PushGoFunc(val.Interface())
+	case reflect.Chan, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return fmt.Errorf("lua: cannot marshal value of type %s", val.Type())
+	default:
+		return goToLua(L, val)
+	}
+	return nil
+}
+
+// Sets the fields of val on the table on top of the stack, embedded structs without
+// a tag are flattened the same way build_marshal_map flattens them
+func marshalStruct(L *State, val reflect.Value, visiting map[visitKey]bool) error {
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, omitempty, skip := field_tag(field)
+		if skip {
+			continue
+		}
+		fv := val.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == "" {
+			if err := marshalStruct(L, fv, visiting); err != nil {
+				return err
+			}
+			continue
+		}
+		if omitempty && fv.IsZero() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		L.PushString(name)
+		if err := marshalValue(L, fv, visiting); err != nil {
+			return err
+		}
+		L.RawSet(-3)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+type tagged struct {
+	Name   string `lua:"name"`
+	Hidden string `lua:"-"`
+	Note   string `json:"note,omitempty"`
+	Count  int
+}
+
+func TestMarshalUnmarshalTags(t *testing.T) {
+	L := newTestState(t)
+	if err := Marshal(L, tagged{Name: "n", Hidden: "h", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("v")
+	run(t, L, `
+		assert(v.name == "n" and v.Count == 2)
+		assert(v.Hidden == nil and v.note == nil)
+		v.note = "x"`)
+	L.GetGlobal("v")
+	var got tagged
+	err := Unmarshal(L, -1, &got)
+	L.Pop(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (tagged{Name: "n", Note: "x", Count: 2}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMarshalCycle(t *testing.T) {
+	L := newTestState(t)
+	m := map[string]interface{}{}
+	m["self"] = m
+	if err := Marshal(L, m); err == nil {
+		t.Error("Marshal of a map containing itself succeeded")
+	}
+	s := []interface{}{nil}
+	s[0] = s
+	if err := Marshal(L, s); err == nil {
+		t.Error("Marshal of a slice containing itself succeeded")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("Marshal left %d values on the stack", L.GetTop())
+	}
+}
+
+func TestMarshalDeeplyNested(t *testing.T) {
+	L := newTestState(t)
+	var v interface{}
+	for i := 0; i < 1<<20; i++ {
+		v = []interface{}{v}
+	}
+	if err := Marshal(L, v); err == nil {
+		t.Error("Marshal of a value deeper than the Lua stack succeeded")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("Marshal left %d values on the stack", L.GetTop())
+	}
+}
+
+func TestMarshalConcurrentStates(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L, err := NewState(true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer L.Close()
+			for j := 0; j < 100; j++ {
+				if err := Marshal(L, tagged{Name: "n"}); err != nil {
+					t.Error(err)
+					return
+				}
+				var got tagged
+				if err := Unmarshal(L, -1, &got); err != nil {
+					t.Error(err)
+					return
+				}
+				L.Pop(1)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type counter struct {
+	N int
+}
+
+func (c *counter) Add(n int) int {
+	c.N += n
+	return c.N
+}
+
+func (c *counter) Equals(o *counter) bool {
+	return c.N == o.N
+}
+
+func TestMethodCallStyles(t *testing.T) {
+	L := newTestState(t)
+	c := &counter{}
+	pushGlobal(t, L, "c", c)
+	run(t, L, `
+		assert(c:Add(1) == 1)
+		assert(c.Add(2) == 3)
+		local f = c.Add
+		assert(f(3) == 6)
+		assert(f(4) == 10)
+		assert(rawequal(c.Add, c.Add))`)
+	if c.N != 10 {
+		t.Errorf("N = %d", c.N)
+	}
+}
+
+func TestMethodTakingReceiverType(t *testing.T) {
+	L := newTestState(t)
+	pushGlobal(t, L, "a", &counter{N: 1})
+	pushGlobal(t, L, "b", &counter{N: 1})
+	pushGlobal(t, L, "z", &counter{N: 2})
+	run(t, L, `
+		assert(a:Equals(b))
+		assert(a.Equals(b))
+		assert(a.Equals(a))
+		assert(not a:Equals(z))
+		assert(not a.Equals(z))`)
+}
+
+type logger struct{}
+
+func (l *logger) Log(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...)
+}
+
+func (l *logger) Pad(s string, width int) string {
+	return fmt.Sprintf("%*s", width, s)
+}
+
+func TestMethodArgumentPolicies(t *testing.T) {
+	L := newTestState(t)
+	pushGlobal(t, L, "log", &logger{})
+	run(t, L, `
+		assert(log:Log("%d-%s", 1, "a") == "1-a")
+		assert(log:Log("plain") == "plain")
+		assert(log.Log("%s", "dot") == "dot")
+		assert(log:Pad("a", 3, "extra") == "  a")`)
+	err := L.LoadCodeString(`log:Pad("a")`, "missing")
+	if err == nil || !strings.Contains(err.Error(), "*lua.logger.Pad") {
+		t.Errorf("missing argument error = %v", err)
+	}
+	L.SetZeroFillArgs(true)
+	run(t, L, `assert(log:Pad("a") == "a")`)
+	L.SetRejectExtraArgs(true)
+	err = L.LoadCodeString(`log:Pad("a", 3, "extra")`, "extra")
+	if err == nil || !strings.Contains(err.Error(), "too many arguments to '*lua.logger.Pad'") {
+		t.Errorf("extra argument error = %v", err)
+	}
+	run(t, L, `assert(log:Log("%d%d%d", 1, 2, 3) == "123")`)
+}
+
+func TestReturnErrorsConvention(t *testing.T) {
+	L := newTestState(t)
+	L.SetErrorConvention(ReturnErrors)
+	pushGlobal(t, L, "acc", &account{})
+	run(t, L, `
+		local v, msg = acc:Deposit(-1)
+		result = tostring(v) .. " " .. msg
+		ok = acc:Deposit(2)`)
+	if got := globalString(t, L, "result"); got != "nil negative deposit" {
+		t.Errorf("result = %q", got)
+	}
+	if n, _ := GetGlobalAs[int](L, "ok"); n != 2 {
+		t.Errorf("ok = %d", n)
+	}
+}
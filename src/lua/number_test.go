@@ -0,0 +1,66 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUint64RoundTrip(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		L := newTestState(t)
+		L.SetStrictConversion(strict)
+		L.ExportFunc("id", func(u uint64) uint64 { return u })
+		const big = uint64(math.MaxInt64)
+		got, err := CallAs[uint64](L, "id", big)
+		if err != nil || got != big {
+			t.Errorf("strict %v: id(%d) = %d, %v", strict, big, got, err)
+		}
+		if _, err := CallAs[uint64](L, "id", big+1); err == nil {
+			t.Errorf("strict %v: pushing %d succeeded", strict, big+1)
+		}
+	}
+}
+
+func TestLenientIntegerOverflow(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("small", func(n int8) int8 { return n })
+	L.ExportFunc("unsigned", func(n uint64) uint64 { return n })
+	run(t, L, `assert(small(-128) == -128 and unsigned(0) == 0)`)
+	for _, code := range []string{`small(300)`, `small(-129)`, `unsigned(-1)`, `unsigned(-1.5)`} {
+		if err := L.LoadCodeString(code, "lenient"); err == nil {
+			t.Errorf("%s succeeded", code)
+		}
+	}
+}
+
+func TestStrictConversion(t *testing.T) {
+	L := newTestState(t)
+	L.ExportFunc("small", func(n int8) int8 { return n })
+	run(t, L, `lenient = small("12")`)
+	L.SetStrictConversion(true)
+	for _, code := range []string{`small(300)`, `small("12")`, `small(1.5)`, `small()`} {
+		if err := L.LoadCodeString(code, "strict"); err == nil {
+			t.Errorf("%s succeeded in strict mode", code)
+		}
+	}
+	pushGlobal(t, L, "acc", &account{})
+	if err := L.LoadCodeString(`acc.missing = 1`, "strict"); err == nil {
+		t.Error("setting an unknown field succeeded in strict mode")
+	}
+}
@@ -0,0 +1,71 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+/*
+#include "luanative.h"
+*/
+import "C"
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Pushes the value at a dotted path of globals such as "config.server.port", nil if
+// any part of the path is missing. The lookup runs in protected mode, a failing
+// __index metamethod is returned as an error and nil is pushed in that case.
+func (L *State) GetPath(path string) error {
+	C.pushPathGetter(L.s)
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		L.PushString(part)
+	}
+	err := L.PCall(len(parts), 1)
+	if err != nil {
+		L.PushNil()
+	}
+	return err
+}
+
+// Sets the value at a dotted path of globals such as "app.handlers.auth", creating the
+// missing tables along the way. The value is converted like PushInterface converts it,
+// an error is returned if a part of the path holds something other than a table.
+func (L *State) SetPath(path string, value interface{}) error {
+	top := L.GetTop()
+	C.pushPathSetter(L.s)
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		L.PushString(part)
+	}
+	if err := goToLua(L, reflect.ValueOf(value)); err != nil {
+		L.SetTop(top)
+		return err
+	}
+	return L.PCall(len(parts)+1, 0)
+}
+
+// Converts the value at the dotted path into a T, see GetPath and Get
+func GetPathAs[T any](L *State, path string) (T, error) {
+	top := L.GetTop()
+	defer L.SetTop(top)
+	if err := L.GetPath(path); err != nil {
+		var zero T
+		return zero, err
+	}
+	return Get[T](L, -1)
+}
@@ -0,0 +1,41 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import "testing"
+
+func TestPaths(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `config = {server = {port = 8080}}; flat = 1`)
+	if port, err := GetPathAs[int](L, "config.server.port"); err != nil || port != 8080 {
+		t.Errorf("port = %d, %v", port, err)
+	}
+	if err := L.GetPath("config.missing.port"); err != nil || !L.IsNil(-1) {
+		t.Errorf("missing path = %s, %v", L.Typename(L.Type(-1)), err)
+	}
+	L.Pop(1)
+	if err := L.SetPath("app.handlers.auth", "on"); err != nil {
+		t.Fatal(err)
+	}
+	run(t, L, `assert(app.handlers.auth == "on")`)
+	if err := L.SetPath("flat.x", 1); err == nil {
+		t.Error("setting a field of a number succeeded")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
@@ -0,0 +1,41 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import "testing"
+
+func TestPushInterfaceValues(t *testing.T) {
+	L := newTestState(t)
+	n := 5
+	for name, v := range map[string]interface{}{
+		"i": 42, "f": 1.5, "s": "str", "b": true, "none": nil,
+		"fn": func(a int) int { return a + 1 }, "ch": make(chan int), "ptr": &n,
+		"list": []int{1, 2}, "dict": map[string]int{"k": 1},
+	} {
+		pushGlobal(t, L, name, v)
+	}
+	run(t, L, `
+		assert(math.type(i) == "integer" and i == 42)
+		assert(math.type(f) == "float" and f == 1.5)
+		assert(s == "str" and b == true and none == nil)
+		assert(fn(1) == 2)
+		assert(type(ch) == "userdata" and type(ptr) == "userdata")
+		assert(list[2] == 2 and dict.k == 1)`)
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
@@ -0,0 +1,72 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import "testing"
+
+func TestOperators(t *testing.T) {
+	L := newTestState(t)
+	L.PushInteger(7)
+	L.PushInteger(2)
+	if lt, err := L.Compare(-1, -2, OPLT); err != nil || !lt {
+		t.Errorf("2 < 7 = %v, %v", lt, err)
+	}
+	if err := L.Arith(OPIDIV); err != nil || L.ToInteger(-1) != 3 {
+		t.Errorf("7 // 2 = %d, %v", L.ToInteger(-1), err)
+	}
+	L.PushString("x")
+	if err := L.Concat(2); err != nil || L.ToString(-1) != "3x" {
+		t.Errorf("3 .. x = %q, %v", L.ToString(-1), err)
+	}
+	if err := L.Len(-1); err != nil || L.ToInteger(-1) != 2 {
+		t.Errorf("#'3x' = %d, %v", L.ToInteger(-1), err)
+	}
+	L.SetTop(0)
+	if eq, err := L.Compare(1, 2, OPEQ); err != nil || eq {
+		t.Errorf("comparing invalid indices = %v, %v", eq, err)
+	}
+}
+
+func TestOperatorErrors(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `
+		tbl = {}
+		bad = setmetatable({}, {__len = function() error("no length") end})`)
+	L.GetGlobal("tbl")
+	L.PushInteger(1)
+	if _, err := L.Compare(-1, -2, OPLT); err == nil {
+		t.Error("comparing a number and a table succeeded")
+	}
+	if err := L.Arith(OPADD); err == nil {
+		t.Error("adding a table succeeded")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("Arith left %d values on the stack", L.GetTop())
+	}
+	L.PushBoolean(true)
+	L.PushString("x")
+	if err := L.Concat(2); err == nil {
+		t.Error("concatenating a boolean succeeded")
+	}
+	L.GetGlobal("bad")
+	if err := L.Len(-1); err == nil {
+		t.Error("Len with a failing __len succeeded")
+	}
+	if L.GetTop() != 1 {
+		t.Errorf("Len left %d values on the stack", L.GetTop())
+	}
+}
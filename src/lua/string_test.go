@@ -0,0 +1,53 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryStrings(t *testing.T) {
+	L := newTestState(t)
+	payload := []byte{'a', 0, 'b', 0xff}
+	L.PushBytes(payload)
+	if got := L.ToBytes(-1); !bytes.Equal(got, payload) {
+		t.Errorf("ToBytes = %q", got)
+	}
+	L.PushString("x\x00y")
+	if got := L.ToString(-1); got != "x\x00y" {
+		t.Errorf("ToString = %q", got)
+	}
+	L.SetTop(0)
+
+	var got []byte
+	L.ExportFunc("take", func(b []byte) { got = b })
+	L.ExportFunc("give", func() []byte { return payload })
+	run(t, L, `
+		local s = "a\0b"
+		assert(#s == 3)
+		take(s)
+		assert(type(give()) == "string" and #give() == 4)`)
+	if !bytes.Equal(got, []byte("a\x00b")) {
+		t.Errorf("take got %q", got)
+	}
+	// A NUL byte in the code itself is kept, not taken as the end of the chunk
+	err := L.LoadCodeString("x = 1\x00", "nul")
+	if err == nil {
+		t.Error("code with a NUL byte was cut at the NUL")
+	}
+}
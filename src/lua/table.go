@@ -0,0 +1,152 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+/*
+#include "luanative.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"reflect"
+)
+
+// A Lua table held by Go. The table is kept in the registry so the handle does not
+// depend on the current stack layout, keys and values are converted the same way as
+// arguments of Go functions. Call Release once the table is no longer needed,
+// otherwise it is released when the Table is garbage collected.
+type Table struct {
+	*luaRef
+}
+
+// Returns a handle to the table at the given index, nil if the value is not a table
+func (L *State) ToTable(idx int) *Table {
+	if L.Type(idx) != TTABLE {
+		return nil
+	}
+	return &Table{L.newLuaRef(idx)}
+}
+
+var errReleasedTable = errors.New("lua: use of a released table")
+
+// Returns t[key], honoring the __index metamethod. An error raised by the metamethod
+// is returned as a LuaError.
+func (t *Table) Get(key interface{}) (interface{}, error) {
+	return t.access(C.TABLE_GET, key)
+}
+
+// Returns t[key] without invoking metamethods
+func (t *Table) RawGet(key interface{}) (interface{}, error) {
+	return t.access(C.TABLE_RAWGET, key)
+}
+
+// Sets t[key] = value, honoring the __newindex metamethod. Keys can not be nil or NaN.
+func (t *Table) Set(key interface{}, value interface{}) error {
+	_, err := t.access(C.TABLE_SET, key, value)
+	return err
+}
+
+// Sets t[key] = value without invoking metamethods
+func (t *Table) RawSet(key interface{}, value interface{}) error {
+	_, err := t.access(C.TABLE_RAWSET, key, value)
+	return err
+}
+
+// Returns the length of the table as the # operator does
+func (t *Table) Len() (int, error) {
+	n, err := t.access(C.TABLE_LEN)
+	if err != nil {
+		return 0, err
+	}
+	l, _ := n.(int64)
+	return int(l), nil
+}
+
+// Runs the table operation under PCall with the table and the converted args, so errors
+// of metamethods come back as a LuaError instead of unwinding over Go frames
+func (t *Table) access(op C.int, args ...interface{}) (interface{}, error) {
+	if t.ref == refReleased {
+		return nil, errReleasedTable
+	}
+	L := t.L
+	top := L.GetTop()
+	defer L.SetTop(top)
+	C.pushTableAccess(L.s, op)
+	t.push()
+	for _, arg := range args {
+		if err := goToLua(L, reflect.ValueOf(arg)); err != nil {
+			return nil, err
+		}
+	}
+	if op == C.TABLE_SET || op == C.TABLE_RAWSET {
+		if L.IsNil(-2) {
+			return nil, errors.New("lua: table index is nil")
+		}
+		if n, ok := L.ToNumberX(-2); ok && L.Type(-2) == TNUMBER && n != n {
+			return nil, errors.New("lua: table index is NaN")
+		}
+	}
+	if err := L.PCall(len(args)+1, 1); err != nil {
+		return nil, err
+	}
+	return L.toGoValue(-1), nil
+}
+
+// Sets value at the end of the sequence, t[#t + 1] = value
+func (t *Table) Append(value interface{}) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+	return t.Set(n+1, value)
+}
+
+// Calls fn for every key/value pair in the table, stops at the first error fn returns
+// and returns it. The table must not get new keys while it is being traversed.
+func (t *Table) ForEach(fn func(k, v interface{}) error) error {
+	if t.ref == refReleased {
+		return errReleasedTable
+	}
+	L := t.L
+	top := L.GetTop()
+	defer L.SetTop(top)
+	t.push()
+	L.PushNil()
+	for L.Next(-2) != 0 {
+		if err := fn(L.toGoValue(-2), L.toGoValue(-1)); err != nil {
+			return err
+		}
+		L.Pop(1)
+	}
+	return nil
+}
+
+// Returns all the keys of the table, in the order lua_next visits them
+func (t *Table) Keys() ([]interface{}, error) {
+	keys := make([]interface{}, 0)
+	err := t.ForEach(func(k, v interface{}) error {
+		keys = append(keys, k)
+		return nil
+	})
+	return keys, err
+}
+
+// Releases the reference to the Lua table, the Table can not be used afterwards
+func (t *Table) Release() {
+	t.release()
+}
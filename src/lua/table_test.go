@@ -0,0 +1,93 @@
+/**
+ * Copyright [2015] [Gihan Munasinghe ayeshka@gmail.com ]
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package lua
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTableAccess(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `cfg = {name = "x", ports = {80, 443}}`)
+	L.GetGlobal("cfg")
+	cfg := L.ToTable(-1)
+	L.Pop(1)
+	defer cfg.Release()
+	if v, err := cfg.Get("name"); err != nil || v != "x" {
+		t.Errorf("name = %v, %v", v, err)
+	}
+	if err := cfg.Set("debug", true); err != nil {
+		t.Fatal(err)
+	}
+	run(t, L, `assert(cfg.debug == true)`)
+	keys, err := cfg.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.(string))
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "debug,name,ports" {
+		t.Errorf("keys = %v", names)
+	}
+	stop := errors.New("stop")
+	n := 0
+	err = cfg.ForEach(func(k, v interface{}) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("ForEach = %v after %d calls", err, n)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("%d values left on the stack", L.GetTop())
+	}
+}
+
+func TestTableErrors(t *testing.T) {
+	L := newTestState(t)
+	run(t, L, `
+		strict = setmetatable({}, {__newindex = function() error("read only") end})
+		plain = {}`)
+	L.GetGlobal("strict")
+	strict := L.ToTable(-1)
+	L.GetGlobal("plain")
+	plain := L.ToTable(-1)
+	L.Pop(2)
+
+	if err := strict.Set("k", 1); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("Set through erroring __newindex = %v", err)
+	}
+	if err := plain.Set(nil, 1); err == nil {
+		t.Error("Set with a nil key succeeded")
+	}
+	if err := plain.Append("x"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := plain.Len(); n != 1 || err != nil {
+		t.Errorf("Len = %d, %v", n, err)
+	}
+	plain.Release()
+	if _, err := plain.Get(1); err == nil {
+		t.Error("Get on a released table succeeded")
+	}
+}
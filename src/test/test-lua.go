@@ -2,6 +2,7 @@ package main
 
 import (
 	"lua"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -35,6 +36,10 @@ func (t *TestStruct) D(abc string ) *TestStruct{
 	return s
 }
 
+func (t *TestStruct) F() error {
+	return errors.New("failed from go")
+}
+
 func (t *TestStruct) E(b string, a *TestStruct) {
 	print("printing gihen")
 	print (a.Gihan)
@@ -73,8 +78,10 @@ func (f *PrintFunc) Name() string{
 
 func (f *PrintFunc) Invoke(L * lua.State) int{
 //	print ("print from go " + strconv.Itoa(L.GetTop())+"  "+L.ToString(1))
-	v := L.ToInterface(1)
-	t := (v).(*TestStruct)
+	t, err := lua.Get[*TestStruct](L, 1)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
 	print (t.Gihan)
 	return 0
 }
@@ -89,7 +96,7 @@ func (f *AddFnc) Name() string{
 
 
 func (f *AddFnc) Invoke(L * lua.State) int{
-	a := L.ToInteger(1) + L.ToInteger(2)
+	a := L.CheckInteger(1) + L.CheckInteger(2)
 	L.PushInteger(a)
 	return 1
 }
@@ -125,6 +132,7 @@ t = p.TS
 print(p.TS.E("hello",p:d("baba"))) 
 x = p.d("") 
 x = nil
+print(pcall(p.F, p))
 p.Test = "hello" 
 return {test="hello " .. p.Map.test1, yo="hi"} 
 end`